@@ -0,0 +1,50 @@
+package notepet
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Errors returned by Authenticator
+var (
+	ErrNoCredentials      = errors.New("error: request has no credentials")
+	ErrInvalidCredentials = errors.New("error: invalid credentials")
+)
+
+// Authenticator authenticates requests to API. TokenStore authenticates
+// them by Notepet-Token header and JWTAuthenticator by bearer JWT in
+// Authorization header.
+type Authenticator interface {
+	// Authenticate returns User who has made request. It returns
+	// ErrNoCredentials if request bears no credentials known to
+	// Authenticator and ErrInvalidCredentials (possibly wrapped
+	// with reason) if they do not check out.
+	Authenticate(*http.Request) (User, error)
+}
+
+// Authenticators tries each of Authenticator in turn. Request is
+// authenticated by the first one which finds credentials in it.
+type Authenticators []Authenticator
+
+// Authenticate implements Authenticator
+func (as Authenticators) Authenticate(r *http.Request) (User, error) {
+	for _, a := range as {
+		if u, err := a.Authenticate(r); !errors.Is(err, ErrNoCredentials) {
+			return u, err
+		}
+	}
+	return User{}, ErrNoCredentials
+}
+
+// rejectCredentials returns HTTP status of response to request whose
+// credentials have been rejected with err. Invalid bearer tokens get
+// 401 Unauthorized with WWW-Authenticate header set as RFC 6750 requires,
+// other credentials get 403 Forbidden.
+func rejectCredentials(w http.ResponseWriter, err error) int {
+	var bearer *bearerError
+	if errors.As(err, &bearer) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
@@ -0,0 +1,181 @@
+package notepet
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Change tells that note has been added, changed or deleted. Storage
+// keeps only the latest change of each note. Every change gets sequence
+// number greater than numbers of all earlier changes.
+type Change struct {
+	Seq     int64     `json:"seq"`
+	ID      NoteID    `json:"id"`
+	Deleted bool      `json:"deleted,omitempty"`
+	Time    time.Time `json:"time"`
+	Note    *Note     `json:"note,omitempty"` // current version of note unless it is deleted
+}
+
+// ChangeFeed is a response to request of changes. Last is sequence number
+// of the last change in feed (or requested one if there are no changes)
+// which should be passed as since to get further changes. More tells that
+// feed has been limited and there are more changes after Last.
+type ChangeFeed struct {
+	Changes []Change `json:"changes"`
+	Last    int64    `json:"last"`
+	More    bool     `json:"more,omitempty"`
+}
+
+// ChangeStorage is implemented by Storage which keeps sequence of changes.
+// Changes returns changes with sequence numbers greater than since ordered
+// by sequence number. If limit is positive no more than limit changes are
+// returned.
+type ChangeStorage interface {
+	Changes(since int64, limit int) ([]Change, error)
+}
+
+// ChangeTimeStorage is implemented by ChangeStorage which can look up
+// changes by time. ChangesAfter returns changes made after t ordered by
+// sequence number and sequence number of the latest change kept by
+// storage. If limit is positive no more than limit changes are returned.
+type ChangeTimeStorage interface {
+	ChangesAfter(t time.Time, limit int) (changes []Change, last int64, err error)
+}
+
+// Changes returns feed of changes made in st after change with sequence
+// number since. If st does not implement ChangeStorage all notes of st
+// edited later than since are returned with their LastEdited in Unix
+// nanoseconds as sequence numbers. Deleted notes are not reported then.
+func Changes(st Storage, since int64, limit int) (ChangeFeed, error) {
+	feed := ChangeFeed{Changes: []Change{}, Last: since}
+	if st == nil {
+		return feed, ErrStorageIsNil
+	}
+	// ask for one more change to learn if there are more of them
+	query := limit
+	if query > 0 {
+		query++
+	}
+	var changes []Change
+	var err error
+	if cs, ok := st.(ChangeStorage); ok {
+		changes, err = cs.Changes(since, query)
+	} else {
+		changes, err = editedNotes(st, since, query)
+	}
+	if err != nil {
+		return feed, err
+	}
+	if limit > 0 && len(changes) > limit {
+		changes, feed.More = changes[:limit], true
+	}
+	if len(changes) > 0 {
+		feed.Changes = changes
+		feed.Last = changes[len(changes)-1].Seq
+	}
+	return feed, nil
+}
+
+// ChangesSince returns feed of changes made in st after time t. If st
+// does not implement ChangeTimeStorage all changes are fetched and
+// filtered. Last of feed without changes is the sequence number of
+// the latest change in st.
+func ChangesSince(st Storage, t time.Time, limit int) (ChangeFeed, error) {
+	if cts, ok := st.(ChangeTimeStorage); ok {
+		feed := ChangeFeed{Changes: []Change{}}
+		query := limit
+		if query > 0 {
+			query++
+		}
+		changes, last, err := cts.ChangesAfter(t, query)
+		if err != nil {
+			return feed, err
+		}
+		if limit > 0 && len(changes) > limit {
+			changes, feed.More = changes[:limit], true
+		}
+		feed.Last = last
+		if len(changes) > 0 {
+			feed.Changes = changes
+			feed.Last = changes[len(changes)-1].Seq
+		}
+		return feed, nil
+	}
+	feed, err := Changes(st, 0, 0)
+	if err != nil {
+		return feed, err
+	}
+	changes := []Change{}
+	for _, c := range feed.Changes {
+		if c.Time.After(t) {
+			changes = append(changes, c)
+		}
+	}
+	if limit > 0 && len(changes) > limit {
+		changes, feed.More = changes[:limit], true
+	}
+	feed.Changes = changes
+	if len(changes) > 0 {
+		feed.Last = changes[len(changes)-1].Seq
+	}
+	return feed, nil
+}
+
+// parseSince parses since parameter of request of changes:
+// sequence number, date (YYYY-MM-DD) or time (RFC3339).
+func parseSince(s string) (seq int64, t time.Time, err error) {
+	if s == "" {
+		return 0, t, nil
+	}
+	if seq, err = strconv.ParseInt(s, 10, 64); err == nil {
+		return seq, t, nil
+	}
+	t, _, err = parseQueryTime(s)
+	return 0, t, err
+}
+
+// editedNotes reports notes of st which does not keep changes
+func editedNotes(st Storage, since int64, limit int) ([]Change, error) {
+	changes := []Change{}
+	err := StreamNotes(st, func(n Note) error {
+		if seq := n.LastEdited.UnixNano(); seq > since {
+			n := n
+			changes = append(changes, Change{Seq: seq, ID: n.ID, Time: n.LastEdited, Note: &n})
+		}
+		return nil
+	})
+	sortChanges(changes)
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes, err
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Seq < changes[j].Seq })
+}
+
+// scanChanges reads rows of changes joined with notes
+// (seq, id, deleted, changed, title, body, tags, sticky, created, lastedited, owner)
+// and closes rows.
+func scanChanges(rows *sql.Rows) ([]Change, error) {
+	defer rows.Close()
+	changes := []Change{}
+	for rows.Next() {
+		var c Change
+		var title, body, tags, owner sql.NullString
+		var sticky sql.NullBool
+		var created, edited sql.NullTime
+		if err := rows.Scan(&c.Seq, &c.ID, &c.Deleted, &c.Time, &title, &body, &tags, &sticky, &created, &edited, &owner); err != nil {
+			return changes, err
+		}
+		if !c.Deleted && title.Valid {
+			c.Note = &Note{ID: c.ID, Title: title.String, Body: body.String, Tags: tags.String,
+				Sticky: sticky.Bool, TimeStamp: created.Time, LastEdited: edited.Time, Owner: owner.String}
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -2,12 +2,15 @@ package notepet
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // APIClient represents http client fetching notes from notepet server.
@@ -50,6 +53,46 @@ func (ac *APIClient) Get(ids ...NoteID) ([]Note, error) {
 	return bytesToNoteList(data)
 }
 
+// List implements Lister
+func (ac *APIClient) List(opts ListOptions) (Page, error) {
+	params := map[string]string{"action": "get"}
+	if opts.Sort != "" {
+		params["sort"] = opts.Sort
+	}
+	if opts.Limit > 0 {
+		params["limit"] = strconv.Itoa(opts.Limit)
+	}
+	if opts.Offset > 0 {
+		params["offset"] = strconv.Itoa(opts.Offset)
+	}
+	if opts.Cursor != "" {
+		params["cursor"] = opts.Cursor
+	}
+	if len(opts.Tags) > 0 {
+		params["tag"] = strings.Join(opts.Tags, ",")
+		params["match"] = "any"
+		if opts.AllTags {
+			params["match"] = "all"
+		}
+	}
+	req := ac.formRequest(http.MethodGet, params, nil)
+	data, header, err := ac.doRequestHeader(req, http.StatusOK)
+	page := Page{Notes: []Note{}}
+	if err != nil {
+		if header.Get("Notepet-Total-Count") == "0" {
+			// server reports empty list as not found
+			err = nil
+		}
+		return page, err
+	}
+	if page.Notes, err = bytesToNoteList(data); err != nil {
+		return page, err
+	}
+	page.Total, _ = strconv.Atoi(header.Get("Notepet-Total-Count"))
+	page.Next = header.Get("Notepet-Next-Cursor")
+	return page, nil
+}
+
 // Put implements Storage
 func (ac *APIClient) Put(n Note) (NoteID, error) {
 	body := bytes.NewReader(noteToBytes(n))
@@ -72,6 +115,39 @@ func (ac *APIClient) Upd(id NoteID, n Note) (NoteID, error) {
 	return NoteID(data), nil
 }
 
+// Patch implements Patcher
+func (ac *APIClient) Patch(id NoteID, p NotePatch) (NoteID, error) {
+	data, _ := json.Marshal(p)
+	req := ac.formRequest(http.MethodPatch, map[string]string{"action": "upd", "id": id.String()}, bytes.NewReader(data))
+	data, err := ac.doRequest(req, http.StatusAccepted)
+	if err != nil {
+		return BadNoteID, err
+	}
+	return NoteID(data), nil
+}
+
+// UpdIfMatch implements ConditionalUpdater. It replaces note only if
+// its current version matches etag and returns *ConflictError otherwise.
+func (ac *APIClient) UpdIfMatch(id NoteID, n Note, etag string) (NoteID, error) {
+	body := bytes.NewReader(noteToBytes(n))
+	req := ac.formRequest(http.MethodPost, map[string]string{"action": "upd", "id": id.String()}, body)
+	req.Header.Set("If-Match", etag)
+	data, err := ac.doRequest(req, http.StatusAccepted)
+	if err != nil {
+		return BadNoteID, err
+	}
+	return NoteID(data), nil
+}
+
+// DelIfMatch implements ConditionalUpdater. It deletes note only if
+// its current version matches etag and returns *ConflictError otherwise.
+func (ac *APIClient) DelIfMatch(id NoteID, etag string) error {
+	req := ac.formRequest(http.MethodDelete, map[string]string{"action": "del", "id": id.String()}, nil)
+	req.Header.Set("If-Match", etag)
+	_, err := ac.doRequest(req, http.StatusOK)
+	return err
+}
+
 // Del implements Storage
 func (ac *APIClient) Del(id NoteID) error {
 	req := ac.formRequest(http.MethodDelete, map[string]string{"action": "del", "id": id.String()}, nil)
@@ -92,14 +168,181 @@ func (ac *APIClient) Search(query string) ([]Note, error) {
 	return bytesToNoteList(data)
 }
 
+// SearchRanked implements RankedSearcher
+func (ac *APIClient) SearchRanked(query string) ([]SearchResult, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "search", "q": query}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	results := []SearchResult{}
+	if err != nil {
+		return results, err
+	}
+	err = json.Unmarshal(data, &results)
+	return results, err
+}
+
+// History implements HistoryStorage
+func (ac *APIClient) History(id NoteID) ([]Revision, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "history", "id": id.String()}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	revs := []Revision{}
+	if err != nil {
+		return revs, err
+	}
+	err = json.Unmarshal(data, &revs)
+	return revs, err
+}
+
+// Revision implements HistoryStorage
+func (ac *APIClient) Revision(id NoteID, rev int) (Revision, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "history", "id": id.String(), "rev": strconv.Itoa(rev)}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	var r Revision
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Tags implements TagStorage
+func (ac *APIClient) Tags() ([]TagCount, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "tags"}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	counts := []TagCount{}
+	if err != nil {
+		return counts, err
+	}
+	err = json.Unmarshal(data, &counts)
+	return counts, err
+}
+
+// GetByTags implements TagStorage
+func (ac *APIClient) GetByTags(tags []string, all bool) ([]Note, error) {
+	params := map[string]string{"action": "get", "tag": strings.Join(tags, ","), "match": "any"}
+	if all {
+		params["match"] = "all"
+	}
+	req := ac.formRequest(http.MethodGet, params, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	if err != nil {
+		return []Note{}, err
+	}
+	return bytesToNoteList(data)
+}
+
+// Changes implements ChangeStorage
+func (ac *APIClient) Changes(since int64, limit int) ([]Change, error) {
+	params := map[string]string{"action": "changes", "since": strconv.FormatInt(since, 10)}
+	if limit > 0 {
+		params["limit"] = strconv.Itoa(limit)
+	}
+	req := ac.formRequest(http.MethodGet, params, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	if err != nil {
+		return []Change{}, err
+	}
+	var feed ChangeFeed
+	err = json.Unmarshal(data, &feed)
+	return feed.Changes, err
+}
+
+// Trash implements TrashStorage
+func (ac *APIClient) Trash() ([]DeletedNote, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "trash"}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	notes := []DeletedNote{}
+	if err != nil {
+		return notes, err
+	}
+	err = json.Unmarshal(data, &notes)
+	return notes, err
+}
+
+// Undelete implements TrashStorage
+func (ac *APIClient) Undelete(id NoteID) error {
+	req := ac.formRequest(http.MethodPost, map[string]string{"action": "undelete", "id": id.String()}, nil)
+	_, err := ac.doRequest(req, http.StatusOK)
+	return err
+}
+
+// EmptyTrash implements TrashStorage
+func (ac *APIClient) EmptyTrash(t time.Time) (int, error) {
+	req := ac.formRequest(http.MethodDelete, map[string]string{"action": "emptytrash", "before": t.Format(time.RFC3339Nano)}, nil)
+	data, err := ac.doRequest(req, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+// Shares implements ShareStorage
+func (ac *APIClient) Shares(id NoteID) ([]Share, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "shares", "id": id.String()}, nil)
+	return ac.doShares(req)
+}
+
+// SharedWith implements ShareStorage
+func (ac *APIClient) SharedWith(grantees []string) ([]Share, error) {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "shares", "grantee": strings.Join(grantees, ",")}, nil)
+	return ac.doShares(req)
+}
+
+func (ac *APIClient) doShares(req *http.Request) ([]Share, error) {
+	data, err := ac.doRequest(req, http.StatusOK)
+	shares := []Share{}
+	if err != nil {
+		return shares, err
+	}
+	err = json.Unmarshal(data, &shares)
+	return shares, err
+}
+
+// Share implements ShareStorage
+func (ac *APIClient) Share(s Share) error {
+	req := ac.formRequest(http.MethodPost, map[string]string{"action": "share", "id": s.ID.String(), "grantee": s.Grantee, "access": s.Access}, nil)
+	_, err := ac.doRequest(req, http.StatusOK)
+	return err
+}
+
+// Unshare implements ShareStorage
+func (ac *APIClient) Unshare(id NoteID, grantee string) error {
+	req := ac.formRequest(http.MethodDelete, map[string]string{"action": "unshare", "id": id.String(), "grantee": grantee}, nil)
+	_, err := ac.doRequest(req, http.StatusOK)
+	return err
+}
+
 //ExportJSON implements Storage
 func (ac *APIClient) ExportJSON() ([]byte, error) {
+	return ExportJSON(ac)
+}
+
+// StreamNotes implements NoteStreamer. Notes are requested as NDJSON
+// and passed to fn as soon as each of them is received.
+func (ac *APIClient) StreamNotes(fn func(Note) error) error {
 	req := ac.formRequest(http.MethodGet, map[string]string{"action": "get"}, nil)
-	data, err := ac.doRequest(req, http.StatusOK)
+	req.Header.Set("Accept", NDJSONContentType)
+	resp, err := ac.send(req, http.StatusOK)
+	if err != nil {
+		if resp != nil && resp.Header.Get("Notepet-Total-Count") == "0" {
+			return nil // server reports empty storage as not found
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	return DecodeNotes(resp.Body, fn)
+}
+
+// Watch subscribes to events of notes changed on server and calls fn for
+// each of them until connection is closed or fn returns error.
+func (ac *APIClient) Watch(fn func(Event) error) error {
+	req := ac.formRequest(http.MethodGet, map[string]string{"action": "events"}, nil)
+	req.Header.Set("Accept", EventStreamContentType)
+	resp, err := ac.send(req, http.StatusOK)
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
-	return data, nil
+	defer resp.Body.Close()
+	return readEvents(resp.Body, fn)
 }
 
 // Close implements Storage
@@ -115,15 +358,46 @@ func (ac *APIClient) formRequest(method string, params map[string]string, body i
 }
 
 func (ac *APIClient) doRequest(r *http.Request, needstatus int) ([]byte, error) {
-	resp, err := ac.HTTPClient.Do(r)
+	data, _, err := ac.doRequestHeader(r, needstatus)
+	return data, err
+}
+
+// doRequestHeader is like doRequest but also returns header of response
+func (ac *APIClient) doRequestHeader(r *http.Request, needstatus int) ([]byte, http.Header, error) {
+	resp, err := ac.send(r, needstatus)
 	if err != nil {
-		return []byte{}, err
+		if resp != nil {
+			return []byte{}, resp.Header, err
+		}
+		return []byte{}, nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != needstatus {
-		return []byte{}, fmt.Errorf("server returned: %v", resp.Status)
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.Header, err
+}
+
+// send does request and checks status of response. If status is
+// as needed response is returned with body to be read and closed
+// by caller. Otherwise body is closed and error is returned with
+// response (if there was one) to look at its header.
+func (ac *APIClient) send(r *http.Request, needstatus int) (*http.Response, error) {
+	resp, err := ac.HTTPClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == needstatus {
+		return resp, nil
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed,
+		resp.StatusCode == http.StatusConflict && r.Header.Get("If-Match") != "":
+		id := NoteID(r.URL.Query().Get("id"))
+		return resp, &ConflictError{ID: id, ETag: resp.Header.Get("ETag")}
+	case resp.StatusCode == http.StatusConflict:
+		return resp, ErrNoteExists
 	}
-	return io.ReadAll(resp.Body)
+	return resp, fmt.Errorf("server returned: %v", resp.Status)
 }
 
 func (ac *APIClient) formUrlFromMap(params map[string]string) url.URL {
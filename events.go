@@ -0,0 +1,234 @@
+package notepet
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of events published by APIHandler
+const (
+	EventCreated = "created" // note added or restored from trash
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// EventSticky follows EventUpdated if update has made note sticky
+	EventSticky = "sticky"
+)
+
+// EventStreamContentType is media type of Server-Sent Events
+const EventStreamContentType = "text/event-stream"
+
+// eventKeepAlive is interval of comments sent to idle event
+// streams so that proxies do not close them.
+var eventKeepAlive = 30 * time.Second
+
+// Event tells that note has been changed through APIHandler
+type Event struct {
+	Type string    `json:"type"`
+	ID   NoteID    `json:"id"`
+	Time time.Time `json:"time"`
+	Note *Note     `json:"note,omitempty"` // current version of note unless it is deleted
+}
+
+// EventBus passes published events to all subscribers.
+// Methods of nil *EventBus do nothing.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// NewEventBus returns EventBus ready to use
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns channel receiving events published from now on and
+// function to cancel subscription. If subscriber does not keep up with
+// events and more than buffer of them are pending, new events are dropped.
+// Channel is closed when subscription is cancelled or bus is closed.
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	if b == nil {
+		close(ch)
+		return ch, func() {}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Publish passes e to all subscribers without waiting for them
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("dropped %v event of note %v for slow subscriber\n", e.Type, e.ID)
+		}
+	}
+}
+
+// Close cancels all subscriptions. Events published
+// after Close are not passed to anyone.
+func (b *EventBus) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.closed = true
+}
+
+// publish tells subscribers of ah.Events that note with id has been changed
+func (ah *APIHandler) publish(typ string, id NoteID) {
+	if ah.Events == nil {
+		return
+	}
+	ah.Events.Publish(ah.newEvent(typ, id))
+}
+
+// publishUpdate publishes EventUpdated of note with id and EventSticky
+// if note has become sticky. wasSticky should be obtained with isSticky
+// before update.
+func (ah *APIHandler) publishUpdate(id NoteID, wasSticky bool) {
+	if ah.Events == nil {
+		return
+	}
+	e := ah.newEvent(EventUpdated, id)
+	ah.Events.Publish(e)
+	if e.Note != nil && e.Note.Sticky && !wasSticky {
+		e.Type = EventSticky
+		ah.Events.Publish(e)
+	}
+}
+
+// isSticky reports whether note with id is sticky. It does not bother
+// to look at note if no one is interested in events.
+func (ah *APIHandler) isSticky(id NoteID) bool {
+	if ah.Events == nil {
+		return false
+	}
+	notes, err := ah.Storage.Get(id)
+	return err == nil && len(notes) == 1 && notes[0].Sticky
+}
+
+func (ah *APIHandler) newEvent(typ string, id NoteID) Event {
+	e := Event{Type: typ, ID: id, Time: time.Now()}
+	if typ != EventDeleted {
+		if notes, err := ah.Storage.Get(id); err == nil && len(notes) == 1 {
+			e.Note = &notes[0]
+		}
+	}
+	return e
+}
+
+// eventFilter returns function telling which events user who has
+// made request may see or nil if they may see all of them.
+func (ah *APIHandler) eventFilter(r *http.Request) func(Event) bool {
+	if us, ok := ah.storage(r).(*userStorage); ok {
+		return us.sees
+	}
+	return nil
+}
+
+// serveEvents writes events of bus to w as Server-Sent Events until
+// client goes away or bus is closed. If visible is not nil only events
+// it reports true for are written.
+func serveEvents(w http.ResponseWriter, r *http.Request, bus *EventBus, visible func(Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := bus.Subscribe(64)
+	defer cancel()
+	w.Header().Set("Content-Type", EventStreamContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, ": notepet events\n\n")
+	flusher.Flush()
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if visible != nil && !visible(e) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// readEvents reads Server-Sent Events from r calling fn for each of them
+// until r is exhausted or fn returns error.
+func readEvents(r io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var e Event
+			err := json.Unmarshal([]byte(data.String()), &e)
+			data.Reset()
+			if err != nil {
+				return err
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,62 @@
+package notepet
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoSuchRevision is returned when requested revision of note is not
+// recorded in the history
+var ErrNoSuchRevision = errors.New("error: no such revision")
+
+// Revision is a previous version of Note recorded by Storage
+// each time the Note is updated.
+type Revision struct {
+	ID         NoteID    `json:"id"`
+	Rev        int       `json:"rev"`
+	Title      string    `json:"title,omitempty"`
+	Body       string    `json:"body,omitempty"`
+	Tags       string    `json:"tags,omitempty"`
+	Sticky     bool      `json:"sticky,omitempty"`
+	LastEdited time.Time `json:"lastedited,omitempty"`
+}
+
+// HistoryStorage is implemented by Storage which keeps previous
+// revisions of notes.
+type HistoryStorage interface {
+	// History returns all recorded revisions of Note with NoteID
+	// starting with the oldest one.
+	History(NoteID) ([]Revision, error)
+	// Revision returns revision of Note with NoteID and revision number.
+	Revision(NoteID, int) (Revision, error)
+}
+
+// RestoreRevision replaces Note with id by its revision rev. The
+// replaced version is recorded in history as with any other update.
+func RestoreRevision(st Storage, id NoteID, rev int) (NoteID, error) {
+	if st == nil {
+		return BadNoteID, ErrStorageIsNil
+	}
+	hs, ok := st.(HistoryStorage)
+	if !ok {
+		return BadNoteID, errors.New("error: storage does not keep history")
+	}
+	r, err := hs.Revision(id, rev)
+	if err != nil {
+		return BadNoteID, err
+	}
+	return st.Upd(id, Note{Title: r.Title, Body: r.Body, Tags: r.Tags, Sticky: r.Sticky})
+}
+
+// newRevision returns revision number rev holding fields of n
+func newRevision(n Note, rev int) Revision {
+	return Revision{
+		ID:         n.ID,
+		Rev:        rev,
+		Title:      n.Title,
+		Body:       n.Body,
+		Tags:       n.Tags,
+		Sticky:     n.Sticky,
+		LastEdited: n.LastEdited,
+	}
+}
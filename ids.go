@@ -0,0 +1,153 @@
+package notepet
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBadNoteID is returned when note is put to Storage with NoteID
+// which is not valid (see ValidNoteID).
+var ErrBadNoteID = errors.New("error: invalid NoteID")
+
+// IDGenerator makes NoteID for a note added to Storage without one
+type IDGenerator interface {
+	NewID(Note) NoteID
+}
+
+// IDGeneratorFunc is an adapter to use ordinary function as IDGenerator
+type IDGeneratorFunc func(Note) NoteID
+
+// NewID calls f(n)
+func (f IDGeneratorFunc) NewID(n Note) NoteID {
+	return f(n)
+}
+
+var (
+	// ULIDGenerator is the default IDGenerator. It makes 26 characters
+	// long ULIDs (https://github.com/ulid/spec) from TimeStamp of note,
+	// so IDs sort in order notes were created. IDs made within the same
+	// millisecond are monotonically increasing.
+	ULIDGenerator IDGenerator = &ulidGenerator{}
+	// SHA256Generator makes 64 hex characters long IDs from Title and
+	// TimeStamp of note as earlier versions did. Notes with the same
+	// title created at the same time get the same ID.
+	SHA256Generator IDGenerator = IDGeneratorFunc(sha256ID)
+)
+
+var idGenerator = struct {
+	sync.RWMutex
+	gen IDGenerator
+}{gen: ULIDGenerator}
+
+// SetIDGenerator sets IDGenerator used by all storages of the package.
+// Passing nil restores ULIDGenerator.
+func SetIDGenerator(gen IDGenerator) {
+	if gen == nil {
+		gen = ULIDGenerator
+	}
+	idGenerator.Lock()
+	defer idGenerator.Unlock()
+	idGenerator.gen = gen
+}
+
+func generateID(n Note) NoteID {
+	idGenerator.RLock()
+	defer idGenerator.RUnlock()
+	return idGenerator.gen.NewID(n)
+}
+
+// ValidNoteID reports whether id may be used as NoteID: it must be from
+// 1 to 64 characters long and consist of ASCII letters, digits, - or _.
+// Both ULIDs and hex IDs made by earlier versions are valid.
+func ValidNoteID(id NoteID) bool {
+	if len(id) == 0 || len(id) > 64 || id == BadNoteID {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// noteIDFor returns ID of note being put to Storage: its own ID
+// if it is set or a new one.
+func noteIDFor(n Note) (NoteID, error) {
+	if n.ID == "" {
+		return generateID(n), nil
+	}
+	if !ValidNoteID(n.ID) {
+		return BadNoteID, ErrBadNoteID
+	}
+	return n.ID, nil
+}
+
+func sha256ID(n Note) NoteID {
+	sum := sha256.New()
+	sum.Write([]byte(n.Title))
+	sum.Write([]byte(n.TimeStamp.String()))
+	s := string(sum.Sum(nil))
+	return NoteID(fmt.Sprintf("%x", s))
+}
+
+// crockford is the base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ulidGenerator struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	lastHi  uint16 // upper 16 bits of 80 random bits
+	lastLow uint64 // lower 64 bits
+}
+
+func (g *ulidGenerator) NewID(n Note) NoteID {
+	t := n.TimeStamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	g.mu.Lock()
+	if ms == g.lastMs {
+		// same millisecond: increment random part of the last
+		// ID so that IDs still sort in order they were made
+		g.lastLow++
+		if g.lastLow == 0 {
+			g.lastHi++
+		}
+	} else {
+		var random [10]byte
+		rand.Read(random[:])
+		g.lastMs = ms
+		g.lastHi = binary.BigEndian.Uint16(random[:2])
+		g.lastLow = binary.BigEndian.Uint64(random[2:])
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	binary.BigEndian.PutUint16(id[6:8], g.lastHi)
+	binary.BigEndian.PutUint64(id[8:16], g.lastLow)
+	g.mu.Unlock()
+	return NoteID(encodeULID(id))
+}
+
+// encodeULID encodes 128 bits as 26 characters of Crockford's base32
+func encodeULID(id [16]byte) string {
+	var out [26]byte
+	// 130 bits of output: two leading zero bits followed by id
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
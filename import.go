@@ -0,0 +1,156 @@
+package notepet
+
+import (
+	"errors"
+	"time"
+)
+
+// ImportStatus tells what has been done with imported note
+type ImportStatus int
+
+const (
+	// ImportAdded means note has been added to Storage
+	ImportAdded ImportStatus = iota
+	// ImportDuplicate means Storage already has the same note
+	// with the same ID. Nothing has been changed.
+	ImportDuplicate
+	// ImportConflict means Storage has different note with the
+	// same ID. Nothing has been changed.
+	ImportConflict
+	// ImportUpdated means note with the same ID has been replaced
+	// with imported note which had been edited later.
+	ImportUpdated
+)
+
+func (s ImportStatus) String() string {
+	switch s {
+	case ImportAdded:
+		return "added"
+	case ImportDuplicate:
+		return "duplicate"
+	case ImportConflict:
+		return "conflict"
+	case ImportUpdated:
+		return "updated"
+	}
+	return "unknown"
+}
+
+// Importer is implemented by Storage which can add notes verbatim:
+// keeping their ID, TimeStamp and LastEdited as they are. Notes without
+// ID get a new one, zero times are set to current time.
+type Importer interface {
+	Import(Note) (ImportStatus, error)
+}
+
+// Replacer is implemented by Storage which can replace existing note
+// with the same ID verbatim. Replaced version is kept in history.
+type Replacer interface {
+	Replace(Note) error
+}
+
+// ImportTx imports notes in a transaction: either all of them
+// are added to Storage on Commit or none of them.
+type ImportTx interface {
+	Importer
+	Replacer
+	Commit() error
+	Rollback() error
+}
+
+// TxImporter is implemented by Storage which supports transactions
+type TxImporter interface {
+	BeginImport() (ImportTx, error)
+}
+
+// ImportReport lists IDs of notes by result of import
+type ImportReport struct {
+	Added      []NoteID `json:"added"`
+	Updated    []NoteID `json:"updated,omitempty"`
+	Duplicates []NoteID `json:"duplicates"`
+	Conflicts  []NoteID `json:"conflicts"`
+	Failed     []NoteID `json:"failed,omitempty"`
+}
+
+func (r *ImportReport) add(id NoteID, status ImportStatus) {
+	switch status {
+	case ImportAdded:
+		r.Added = append(r.Added, id)
+	case ImportDuplicate:
+		r.Duplicates = append(r.Duplicates, id)
+	case ImportConflict:
+		r.Conflicts = append(r.Conflicts, id)
+	case ImportUpdated:
+		r.Updated = append(r.Updated, id)
+	}
+}
+
+// ImportNote adds n to st verbatim if st implements Importer. Otherwise
+// n is added with Put which keeps its ID, but not times of creation and
+// last edit.
+func ImportNote(st Storage, n Note) (ImportStatus, error) {
+	if st == nil {
+		return ImportAdded, ErrStorageIsNil
+	}
+	if imp, ok := st.(Importer); ok {
+		return imp.Import(n)
+	}
+	_, err := st.Put(n)
+	if !errors.Is(err, ErrNoteExists) {
+		return ImportAdded, err
+	}
+	existing, err := st.Get(n.ID)
+	if err != nil || len(existing) == 0 {
+		return ImportConflict, err
+	}
+	return compareImported(existing[0], n), nil
+}
+
+// ReplaceNote replaces note with the same ID in st with n verbatim if st
+// implements Replacer. Otherwise note is replaced with Upd which sets time
+// of last edit to current time.
+func ReplaceNote(st Storage, n Note) error {
+	if st == nil {
+		return ErrStorageIsNil
+	}
+	if r, ok := st.(Replacer); ok {
+		return r.Replace(n)
+	}
+	_, err := st.Upd(n.ID, n)
+	return err
+}
+
+// prepareImport gives note an ID and times if it lacks them
+func prepareImport(n Note) (Note, error) {
+	if n.Title == "" && n.Body == "" {
+		return n, ErrCanNotAddEmptyNote
+	}
+	id, err := noteIDFor(n)
+	if err != nil {
+		return n, err
+	}
+	n.ID = id
+	now := time.Now()
+	if n.TimeStamp.IsZero() {
+		n.TimeStamp = now
+	}
+	if n.LastEdited.IsZero() {
+		n.LastEdited = n.TimeStamp
+	}
+	n.Tags = NormalizeTags(n.Tags)
+	return n, nil
+}
+
+// compareImported tells whether imported note duplicates
+// existing note with the same ID or conflicts with it.
+func compareImported(existing, imported Note) ImportStatus {
+	if sameContent(existing, imported) {
+		return ImportDuplicate
+	}
+	return ImportConflict
+}
+
+func sameContent(a, b Note) bool {
+	return a.Title == b.Title && a.Body == b.Body &&
+		NormalizeTags(a.Tags) == NormalizeTags(b.Tags) && a.Sticky == b.Sticky
+}
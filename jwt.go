@@ -0,0 +1,401 @@
+package notepet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	// hash functions used by JWT signatures
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// JWTKey is a key verifying signatures of JSON Web Tokens
+type JWTKey struct {
+	ID  string      // matches "kid" of token, key without ID matches any token
+	Key interface{} // *rsa.PublicKey, *ecdsa.PublicKey or []byte (HMAC secret)
+}
+
+// JWTAuthenticator implements Authenticator accepting JSON Web Tokens
+// issued by identity provider in "Authorization: Bearer" header of
+// requests. Tokens should be signed with one of Keys (RS256, RS384,
+// RS512, ES256, ES384, ES512 or HS256, HS384, HS512 with HMAC secrets)
+// and should not be expired.
+//
+// Claims are mapped to User: UserClaim holds name of user, user is admin
+// if RoleClaim holds "admin" (or list including it), GroupsClaim holds
+// list of groups. Scopes of notepet found in "scope" (space separated)
+// or "scp" (list) claims limit what user may do.
+type JWTAuthenticator struct {
+	Keys        []JWTKey
+	Issuer      string        // "iss" claim should be equal to Issuer, not checked if empty
+	Audience    string        // "aud" claim should hold Audience, not checked if empty
+	UserClaim   string        // "sub" by default
+	RoleClaim   string        // "role" by default
+	GroupsClaim string        // "groups" by default
+	Leeway      time.Duration // allowed difference of clocks
+}
+
+// NewJWTAuthenticator returns JWTAuthenticator with default claims
+// accepting tokens signed with keys by issuer for audience. Empty issuer
+// or audience is not checked, so that tokens signed with keys for any
+// other application are accepted: pass both unless keys are only used
+// to sign tokens for notepet.
+func NewJWTAuthenticator(keys []JWTKey, issuer, audience string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Keys:        keys,
+		Issuer:      issuer,
+		Audience:    audience,
+		UserClaim:   "sub",
+		RoleClaim:   "role",
+		GroupsClaim: "groups",
+		Leeway:      time.Minute,
+	}
+}
+
+// Authenticate implements Authenticator
+func (ja *JWTAuthenticator) Authenticate(r *http.Request) (User, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return User{}, ErrNoCredentials
+	}
+	claims, err := ja.Verify(strings.TrimSpace(auth[7:]))
+	if err != nil {
+		return User{}, err
+	}
+	return ja.user(claims)
+}
+
+// bearerError tells that bearer token does not check out.
+// It wraps ErrInvalidCredentials.
+type bearerError struct {
+	reason string
+}
+
+func (e *bearerError) Error() string {
+	return ErrInvalidCredentials.Error() + ": " + e.reason
+}
+
+func (e *bearerError) Unwrap() error {
+	return ErrInvalidCredentials
+}
+
+// invalidJWT returns bearerError with reason
+func invalidJWT(format string, args ...interface{}) error {
+	return &bearerError{reason: fmt.Sprintf(format, args...)}
+}
+
+// Verify checks signature, expiry, issuer and audience of token
+// and returns its claims
+func (ja *JWTAuthenticator) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidJWT("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, invalidJWT("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidJWT("malformed token signature")
+	}
+	if !ja.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, invalidJWT("signature of token does not check out")
+	}
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, invalidJWT("malformed token claims")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalidJWT("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(ja.Leeway)) {
+		return nil, invalidJWT("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ja.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalidJWT("token is not valid yet")
+	}
+	if iss, _ := claims["iss"].(string); ja.Issuer != "" && iss != ja.Issuer {
+		return nil, invalidJWT("token is issued by %q", iss)
+	}
+	if ja.Audience != "" && !containsString(stringsClaim(claims, "aud"), ja.Audience) {
+		return nil, invalidJWT("token is not issued for %q", ja.Audience)
+	}
+	return claims, nil
+}
+
+// verifySignature reports whether sig is signature of input made with
+// algorithm alg and one of keys matching kid
+func (ja *JWTAuthenticator) verifySignature(alg, kid string, input, sig []byte) bool {
+	if len(alg) != 5 {
+		return false
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+	for _, k := range ja.Keys {
+		if k.ID != "" && kid != "" && k.ID != kid {
+			continue
+		}
+		switch key := k.Key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			if strings.HasPrefix(alg, "ES") && verifyES(key, hash, digest, sig) {
+				return true
+			}
+		case []byte:
+			if strings.HasPrefix(alg, "HS") {
+				mac := hmac.New(hash.New, key)
+				mac.Write(input)
+				if hmac.Equal(mac.Sum(nil), sig) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// verifyES verifies ECDSA signature made of r and s of fixed size
+// given that curve of key is the one required by hash
+func verifyES(key *ecdsa.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	curves := map[crypto.Hash]elliptic.Curve{
+		crypto.SHA256: elliptic.P256(),
+		crypto.SHA384: elliptic.P384(),
+		crypto.SHA512: elliptic.P521(),
+	}
+	if key.Curve != curves[hash] {
+		return false
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+	return ecdsa.Verify(key, digest, r, s)
+}
+
+// user maps claims of verified token to User
+func (ja *JWTAuthenticator) user(claims map[string]interface{}) (User, error) {
+	u := User{Role: RoleUser}
+	u.Name, _ = claims[ja.UserClaim].(string)
+	if u.Name == "" {
+		return User{}, invalidJWT("token has no %q claim", ja.UserClaim)
+	}
+	if !ValidUserName(u.Name) {
+		return User{}, invalidJWT("user name %q starts with %q", u.Name, GroupPrefix)
+	}
+	if containsString(stringsClaim(claims, ja.RoleClaim), RoleAdmin) {
+		u.Role = RoleAdmin
+	}
+	u.Groups = stringsClaim(claims, ja.GroupsClaim)
+	scoped := false
+	for _, claim := range []string{"scope", "scp"} {
+		if _, ok := claims[claim]; !ok {
+			continue
+		}
+		scoped = true
+		for _, s := range stringsClaim(claims, claim) {
+			if scope, err := ParseScopes(s); err == nil {
+				u.Scopes = append(u.Scopes, scope...)
+			}
+		}
+	}
+	if scoped && len(u.Scopes) == 0 {
+		return User{}, invalidJWT("token grants no scopes of notepet")
+	}
+	return u, nil
+}
+
+// stringsClaim returns values of claim holding either space separated
+// string or list of strings
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReadJWTKeys reads keys verifying JSON Web Tokens from file holding
+// either JSON Web Key Set ({"keys": [...]} with RSA, EC and oct keys)
+// or PEM encoded public keys and certificates. IDs of PEM keys are
+// taken from their "kid" headers.
+func ReadJWTKeys(filename string) ([]JWTKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return ParseJWKS(trimmed)
+	}
+	keys := []JWTKey{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %v in %v: %w", block.Type, filename, err)
+		}
+		keys = append(keys, JWTKey{ID: block.Headers["kid"], Key: key})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %v", filename)
+	}
+	return keys, nil
+}
+
+// ParseJWKS parses JSON Web Key Set. Keys not used for
+// signatures and of unknown types are skipped.
+func ParseJWKS(data []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := []JWTKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch jwk.Kty {
+		case "RSA":
+			key, err = jwkRSA(jwk.N, jwk.E)
+		case "EC":
+			key, err = jwkEC(jwk.Crv, jwk.X, jwk.Y)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(jwk.K)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %q: %w", jwk.Kid, err)
+		}
+		keys = append(keys, JWTKey{ID: jwk.Kid, Key: key})
+	}
+	return keys, nil
+}
+
+func jwkRSA(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exp.Int64())}, nil
+}
+
+func jwkEC(crv, x, y string) (*ecdsa.PublicKey, error) {
+	curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+	curve, ok := curves[crv]
+	if !ok {
+		return nil, fmt.Errorf("unknown curve %q", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("point is not on curve %v", crv)
+	}
+	return key, nil
+}
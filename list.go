@@ -0,0 +1,176 @@
+package notepet
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Orders of notes accepted in ListOptions.Sort
+const (
+	SortStickyFirst = "sticky-first" // sticky notes first, then newest (default)
+	SortCreated     = "created"      // newest first
+	SortLastEdited  = "lastedited"   // most recently edited first
+	SortTitle       = "title"        // alphabetically by title
+)
+
+// ErrBadListOptions is returned when ListOptions hold unknown sort
+// order, negative limit or offset or malformed cursor.
+var ErrBadListOptions = errors.New("error: bad sort, limit, offset or cursor")
+
+// ListOptions select a page of notes. Zero value selects all notes
+// sorted with sticky notes first.
+type ListOptions struct {
+	Sort   string
+	Offset int
+	Limit  int // zero means no limit
+	// Cursor is returned in Page.Next and continues listing after
+	// the last note of previous page. It takes precedence over Offset.
+	Cursor string
+	// Tags if not empty select notes marked with all of them
+	// (if AllTags is true) or with any of them.
+	Tags    []string
+	AllTags bool
+}
+
+// Page is a part of notes list
+type Page struct {
+	Notes []Note `json:"notes"`
+	// Total is the number of notes matching ListOptions
+	// regardless of limit and offset.
+	Total int `json:"total"`
+	// Next is a cursor of the next page. It is empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// Lister is implemented by Storage which can sort and paginate
+// notes itself instead of returning all of them.
+type Lister interface {
+	List(ListOptions) (Page, error)
+}
+
+// List returns a page of notes from st selected by opts. If st does not
+// implement Lister all notes are fetched and paginated in memory.
+func List(st Storage, opts ListOptions) (Page, error) {
+	if st == nil {
+		return Page{Notes: []Note{}}, ErrStorageIsNil
+	}
+	if err := opts.normalize(); err != nil {
+		return Page{Notes: []Note{}}, err
+	}
+	if l, ok := st.(Lister); ok {
+		return l.List(opts)
+	}
+	var notes []Note
+	var err error
+	if len(opts.Tags) > 0 {
+		notes, err = GetByTags(st, opts.Tags, opts.AllTags)
+	} else {
+		notes, err = st.Get()
+	}
+	if err != nil && err != ErrNoNotesFound {
+		return Page{Notes: []Note{}}, err
+	}
+	return paginateNotes(notes, opts), nil
+}
+
+// normalize checks options and replaces cursor with offset it stands for
+func (opts *ListOptions) normalize() error {
+	if opts.Sort == "" {
+		opts.Sort = SortStickyFirst
+	}
+	switch opts.Sort {
+	case SortStickyFirst, SortCreated, SortLastEdited, SortTitle:
+	default:
+		return ErrBadListOptions
+	}
+	if opts.Cursor != "" {
+		offset, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return err
+		}
+		opts.Offset, opts.Cursor = offset, ""
+	}
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return ErrBadListOptions
+	}
+	opts.Tags = ParseTags(strings.Join(opts.Tags, " "))
+	return nil
+}
+
+// listFilter returns SQL condition selecting notes requested by opts
+func listFilter(opts ListOptions, d sqlDialect) (string, []interface{}) {
+	if len(opts.Tags) == 0 {
+		return "true", nil
+	}
+	nodes := make([]QueryNode, len(opts.Tags))
+	for i, tag := range opts.Tags {
+		nodes[i] = TagQuery{tag}
+	}
+	if opts.AllTags {
+		return queryToSQL(AndQuery(nodes), d)
+	}
+	return queryToSQL(OrQuery(nodes), d)
+}
+
+// newPage makes page of notes found with opts out of total matching notes
+func newPage(notes []Note, total int, opts ListOptions) Page {
+	page := Page{Notes: notes, Total: total}
+	if page.Notes == nil {
+		page.Notes = []Note{}
+	}
+	if next := opts.Offset + len(notes); opts.Limit > 0 && next < total {
+		page.Next = encodeCursor(next)
+	}
+	return page
+}
+
+// paginateNotes sorts notes and returns page selected by opts
+func paginateNotes(notes []Note, opts ListOptions) Page {
+	sortNotesBy(notes, opts.Sort)
+	total := len(notes)
+	start, end := opts.Offset, total
+	if start > total {
+		start = total
+	}
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+	return newPage(notes[start:end], total, opts)
+}
+
+// sortNotesBy sorts notes in order named by one of Sort constants
+func sortNotesBy(notes []Note, order string) {
+	switch order {
+	case SortCreated:
+		sort.SliceStable(notes, func(i, j int) bool { return notes[i].TimeStamp.After(notes[j].TimeStamp) })
+	case SortLastEdited:
+		sort.SliceStable(notes, func(i, j int) bool { return notes[i].LastEdited.After(notes[j].LastEdited) })
+	case SortTitle:
+		sort.SliceStable(notes, func(i, j int) bool {
+			return strings.ToLower(notes[i].Title) < strings.ToLower(notes[j].Title)
+		})
+	default:
+		sortNotes(notes)
+	}
+}
+
+// Cursors are opaque to clients. For now they hold offset of the next
+// page, so that storages without keyset pagination can support them.
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o:" + strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), "o:") {
+		return 0, ErrBadListOptions
+	}
+	offset, err := strconv.Atoi(string(data[2:]))
+	if err != nil {
+		return 0, ErrBadListOptions
+	}
+	return offset, nil
+}
@@ -0,0 +1,161 @@
+package notepet
+
+import (
+	"fmt"
+)
+
+// MigrateOptions control how Migrate copies notes
+type MigrateOptions struct {
+	// RegenerateIDs makes destination Storage generate new IDs
+	// for copied notes instead of keeping IDs they have in source.
+	RegenerateIDs bool
+	// Sync makes Migrate replace notes in destination which have been
+	// edited in source later than in destination. Otherwise such notes
+	// are reported as conflicts.
+	Sync bool
+	// DryRun makes Migrate only report what would be done
+	// without changing destination Storage.
+	DryRun bool
+	// Transaction makes Migrate copy notes in a single transaction
+	// if destination implements TxImporter: if any note fails nothing
+	// is copied. Otherwise Migrate copies as many notes as it can.
+	Transaction bool
+	// Progress is called after each note of source if not nil
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress describes note just processed by Migrate
+type MigrateProgress struct {
+	Done     int // number of notes processed so far
+	Total    int // number of notes in source or 0 if unknown
+	Note     Note
+	Previous *Note // version of note in destination if any
+	Status   ImportStatus
+	Err      error
+}
+
+// Migrate copies all notes from src (source) Storage
+// to dst (destination) Storage keeping their IDs and times of
+// creation and last edit if dst implements Importer.
+// If succesful the returned error in nil.
+func Migrate(dst, src Storage) error {
+	_, err := MigrateWithOptions(dst, src, MigrateOptions{})
+	return err
+}
+
+// MigrateWithOptions copies notes from src to dst as requested by opts.
+// Notes which dst already has (duplicates) are skipped, so migration may
+// be safely repeated. Notes with IDs of different notes in dst (conflicts)
+// are not copied unless opts.Sync is set and they have been edited later
+// than notes in dst. The returned report lists what has been done or
+// would be done in dry run. Notes which could not be copied are listed as
+// failed and the first error is returned after all notes are processed.
+func MigrateWithOptions(dst, src Storage, opts MigrateOptions) (ImportReport, error) {
+	var report ImportReport
+	if src == nil || dst == nil {
+		return report, ErrStorageIsNil
+	}
+	existing := make(map[NoteID]Note)
+	if !opts.RegenerateIDs {
+		err := StreamNotes(dst, func(n Note) error {
+			existing[n.ID] = n
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	total := 0
+	if page, err := List(src, ListOptions{Limit: 1}); err == nil {
+		total = page.Total
+	}
+	var target interface {
+		Importer
+		Replacer
+	} = storageImporter{dst}
+	var tx ImportTx
+	if opts.Transaction && !opts.DryRun {
+		if txi, ok := dst.(TxImporter); ok {
+			var err error
+			if tx, err = txi.BeginImport(); err != nil {
+				return report, err
+			}
+			defer tx.Rollback()
+			target = tx
+		}
+	}
+	var firstErr error
+	done := 0
+	err := StreamNotes(src, func(n Note) error {
+		id := n.ID
+		progress := MigrateProgress{Note: n, Status: ImportAdded}
+		if opts.RegenerateIDs {
+			n.ID = ""
+		} else if prev, ok := existing[id]; ok {
+			progress.Previous = &prev
+			progress.Status = planImport(prev, n, opts.Sync)
+		}
+		if !opts.DryRun {
+			switch progress.Status {
+			case ImportAdded:
+				progress.Status, progress.Err = target.Import(n)
+			case ImportUpdated:
+				progress.Err = target.Replace(n)
+			}
+		}
+		if progress.Err != nil {
+			report.Failed = append(report.Failed, id)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error importing note %v: %w", id, progress.Err)
+			}
+		} else {
+			report.add(id, progress.Status)
+		}
+		done++
+		if opts.Progress != nil {
+			progress.Done, progress.Total = done, total
+			opts.Progress(progress)
+		}
+		if tx != nil && progress.Err != nil {
+			return firstErr
+		}
+		return nil
+	})
+	if err == nil && tx != nil {
+		err = tx.Commit()
+	}
+	if err != nil && tx != nil {
+		// nothing has been copied
+		report.Added, report.Updated = nil, nil
+	}
+	if err == nil {
+		err = firstErr
+	}
+	return report, err
+}
+
+// planImport tells what should be done with note n
+// if destination has note prev with the same ID.
+func planImport(prev, n Note, sync bool) ImportStatus {
+	switch {
+	case sameContent(prev, n):
+		return ImportDuplicate
+	case sync && n.LastEdited.After(prev.LastEdited):
+		return ImportUpdated
+	}
+	return ImportConflict
+}
+
+// storageImporter imports notes to Storage which
+// does not support transactions.
+type storageImporter struct {
+	st Storage
+}
+
+func (s storageImporter) Import(n Note) (ImportStatus, error) {
+	return ImportNote(s.st, n)
+}
+
+func (s storageImporter) Replace(n Note) error {
+	return ReplaceNote(s.st, n)
+}
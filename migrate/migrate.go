@@ -3,47 +3,175 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/dmfed/conf"
 	"github.com/dmfed/notepet"
 )
 
-func openStorage(storagename, storagetype string) (notepet.Storage, error) {
+// storageOptions describe one side of migration
+type storageOptions struct {
+	name   string // file name, server address or Postgres DSN
+	kind   string // json, sqlite, network or postgres
+	port   string
+	path   string
+	token  string
+	config string // notepet client config file
+}
+
+func openStorage(opts storageOptions) (notepet.Storage, error) {
 	var st notepet.Storage
 	var err error
-	switch storagetype {
+	switch opts.kind {
 	case "json":
-		st, err = notepet.OpenOrInitJSONFileStorage(storagename)
+		st, err = notepet.OpenOrInitJSONFileStorage(opts.name)
 	case "sqlite":
-		st, err = notepet.OpenOrInitSQLiteStorage(storagename)
+		st, err = notepet.OpenOrInitSQLiteStorage(opts.name)
+	case "postgres":
+		st, err = notepet.OpenPostgresStorageDSN(opts.name)
 	case "network":
-		st, err = nil, fmt.Errorf("Not implemented")
+		if opts.config != "" {
+			if err := readClientConfig(opts.config, &opts); err != nil {
+				return nil, err
+			}
+		}
+		if opts.name == "" {
+			return nil, fmt.Errorf("server address is not specified")
+		}
+		if opts.path == "" {
+			opts.path = "/notes"
+		}
+		st, err = notepet.NewAPIClient(opts.name, opts.port, opts.path, opts.token)
 	default:
 		st, err = nil, fmt.Errorf("Invalid argument passed")
 	}
 	return st, err
 }
 
+// readClientConfig fills server, port, path and token of opts from
+// notepet client config file unless they are set with flags.
+func readClientConfig(filename string, opts *storageOptions) error {
+	parsed, err := conf.ParseFile(filename)
+	if err != nil {
+		return err
+	}
+	for key, value := range map[string]*string{
+		"server": &opts.name,
+		"port":   &opts.port,
+		"path":   &opts.path,
+		"token":  &opts.token,
+	} {
+		if *value == "" {
+			*value = parsed.Get(key).String()
+		}
+	}
+	return nil
+}
+
+func storageFlags(side, description string) *storageOptions {
+	var opts storageOptions
+	flag.StringVar(&opts.name, side, "", description+" storage: file name, server address or Postgres DSN")
+	flag.StringVar(&opts.kind, side[:1]+"t", "", "type of "+description+" storage (json, sqlite, network, postgres)")
+	flag.StringVar(&opts.port, side+"-port", "", "port of "+description+" server")
+	flag.StringVar(&opts.path, side+"-path", "", "API path of "+description+" server (default /notes)")
+	flag.StringVar(&opts.token, side+"-token", "", "app token of "+description+" server")
+	flag.StringVar(&opts.config, side+"-conf", "", "notepet client config file with "+description+" server, port, path and token")
+	return &opts
+}
+
+// changedFields lists fields of note which differ from its previous version
+func changedFields(prev, n notepet.Note) string {
+	var fields []string
+	if prev.Title != n.Title {
+		fields = append(fields, "title")
+	}
+	if prev.Body != n.Body {
+		fields = append(fields, "body")
+	}
+	if notepet.NormalizeTags(prev.Tags) != notepet.NormalizeTags(n.Tags) {
+		fields = append(fields, "tags")
+	}
+	if prev.Sticky != n.Sticky {
+		fields = append(fields, "sticky")
+	}
+	return strings.Join(fields, ", ")
+}
+
+// printDiff prints what is done (or would be done) with note
+func printDiff(p notepet.MigrateProgress) {
+	switch {
+	case p.Err != nil:
+		fmt.Printf("x %v %q: %v\n", p.Note.ID, p.Note.Title, p.Err)
+	case p.Status == notepet.ImportAdded:
+		fmt.Printf("+ %v %q\n", p.Note.ID, p.Note.Title)
+	case p.Status == notepet.ImportUpdated:
+		fmt.Printf("~ %v %q (%s)\n", p.Note.ID, p.Note.Title, changedFields(*p.Previous, p.Note))
+	case p.Status == notepet.ImportConflict:
+		fmt.Printf("! %v %q (%s) edited %v, destination edited %v\n", p.Note.ID, p.Note.Title, changedFields(*p.Previous, p.Note),
+			p.Note.LastEdited.Format("2006-01-02 15:04"), p.Previous.LastEdited.Format("2006-01-02 15:04"))
+	}
+}
+
+// printProgress prints number of processed notes on the same line of stderr
+func printProgress(p notepet.MigrateProgress) {
+	if p.Total > 0 {
+		fmt.Fprintf(os.Stderr, "\rprocessed %d of %d notes", p.Done, p.Total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\rprocessed %d notes", p.Done)
+	}
+}
+
 func main() {
 	var (
-		flagSource          = flag.String("src", "", "source storage")
-		flagDestination     = flag.String("dst", "", "destination storage")
-		flagSourceType      = flag.String("st", "", "type of source storage (json, sqlite, network)")
-		flagDestinationType = flag.String("dt", "", "type of destination storage (json, sqlite, network)")
+		srcOptions      = storageFlags("src", "source")
+		dstOptions      = storageFlags("dst", "destination")
+		flagNewIDs      = flag.Bool("newids", false, "generate new IDs for notes instead of keeping their IDs")
+		flagSync        = flag.Bool("sync", false, "replace notes in destination which have been edited in source later")
+		flagDryRun      = flag.Bool("dry-run", false, "only print what would be copied without changing destination")
+		flagTransaction = flag.Bool("tx", false, "copy all notes in a single transaction if destination supports it")
+		flagVerbose     = flag.Bool("v", false, "print each copied note")
 	)
 	flag.Parse()
-	src, err := openStorage(*flagSource, *flagSourceType)
+	src, err := openStorage(*srcOptions)
 	if err != nil {
 		fmt.Println("failed to open source storage:", err)
 		return
 	}
-	dst, err := openStorage(*flagDestination, *flagDestinationType)
+	defer src.Close()
+	dst, err := openStorage(*dstOptions)
 	if err != nil {
 		fmt.Println("failed to open destination storage:", err)
 		return
 	}
-	if err := notepet.Migrate(dst, src); err != nil {
+	defer dst.Close()
+	opts := notepet.MigrateOptions{
+		RegenerateIDs: *flagNewIDs,
+		Sync:          *flagSync,
+		DryRun:        *flagDryRun,
+		Transaction:   *flagTransaction,
+	}
+	opts.Progress = func(p notepet.MigrateProgress) {
+		if *flagDryRun || *flagVerbose || p.Err != nil || p.Status == notepet.ImportConflict {
+			printDiff(p)
+		} else {
+			printProgress(p)
+		}
+	}
+	report, err := notepet.MigrateWithOptions(dst, src, opts)
+	if !*flagDryRun && !*flagVerbose {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
 		fmt.Println("failed to migrate notes:", err)
-	} else {
+	}
+	prefix := ""
+	if *flagDryRun {
+		prefix = "dry run, nothing changed. "
+	}
+	fmt.Printf("%sadded: %d, updated: %d, unchanged: %d, conflicts: %d, failed: %d\n", prefix,
+		len(report.Added), len(report.Updated), len(report.Duplicates), len(report.Conflicts), len(report.Failed))
+	if err == nil {
 		fmt.Println("all done")
 	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/dmfed/notepet"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "notepet-migrate-*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func Test_readClientConfig(t *testing.T) {
+	config := writeConfig(t, "editor=nano\nserver=10.0.0.10\nport=10000\npath=/api\ntoken=from-file\n")
+	defer os.Remove(config)
+	// port and token are set with flags
+	opts := storageOptions{port: "20000", token: "from-flag"}
+	if err := readClientConfig(config, &opts); err != nil {
+		t.Fatal(err)
+	}
+	want := storageOptions{name: "10.0.0.10", port: "20000", path: "/api", token: "from-flag"}
+	if opts != want {
+		t.Logf("expected %+v, got %+v", want, opts)
+		t.Fail()
+	}
+	if err := readClientConfig(config+".missing", &opts); err == nil {
+		t.Log("missing config file should be reported")
+		t.Fail()
+	}
+}
+
+func Test_openStorage(t *testing.T) {
+	for _, opts := range []storageOptions{
+		{kind: "network"},
+		{kind: "unknown", name: "notes.json"},
+	} {
+		if st, err := openStorage(opts); err == nil {
+			st.Close()
+			t.Logf("opening %+v should fail", opts)
+			t.Fail()
+		}
+	}
+	// Postgres storage is opened only if database is given
+	// by NOTEPET_TEST_POSTGRES_DSN environment variable
+	if dsn := os.Getenv("NOTEPET_TEST_POSTGRES_DSN"); dsn != "" {
+		st, err := openStorage(storageOptions{kind: "postgres", name: dsn})
+		if err != nil {
+			t.Log("could not open Postgres storage:", err)
+			t.Fail()
+		} else {
+			st.Close()
+		}
+	}
+}
+
+func Test_MigrateToAPIClient(t *testing.T) {
+	srcFile, dstFile := "./test_src.json", "./test_dst.json"
+	for _, f := range []string{srcFile, srcFile + ".meta", dstFile, dstFile + ".meta"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	src, err := openStorage(storageOptions{kind: "json", name: srcFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, title := range []string{"first", "second"} {
+		if _, err := src.Put(notepet.Note{Title: title, Body: "migrated"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote, err := notepet.OpenOrInitJSONFileStorage(dstFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	hndlr, _ := notepet.NewAPIHandler(remote, "secret")
+	srv := httptest.NewTLSServer(hndlr)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	config := writeConfig(t, "server="+u.Hostname()+"\nport="+u.Port()+"\ntoken=secret\n")
+	defer os.Remove(config)
+	dst, err := openStorage(storageOptions{kind: "network", path: "/api", config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.(*notepet.APIClient).HTTPClient = srv.Client()
+	if err := notepet.Migrate(dst, src); err != nil {
+		t.Fatal("migration failed:", err)
+	}
+	notes, _ := src.Get()
+	for _, n := range notes {
+		if found, err := remote.Get(n.ID); err != nil || len(found) != 1 || found[0].Title != n.Title {
+			t.Log("note is not migrated:", n.ID, found, err)
+			t.Fail()
+		}
+	}
+}
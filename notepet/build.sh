@@ -1,4 +1,4 @@
-go build -o notepet
+go build -tags sqlite_fts5 -o notepet
 cp notepet $HOME/.local/bin
 echo 'notepet reinstalled'
 
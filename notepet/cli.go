@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dmfed/notepet"
 	"github.com/dmfed/termtools"
@@ -21,6 +23,16 @@ var (
 	noteTagsEnd             = "<"
 )
 
+// markers of three-way diff shown to user when edited note conflicts
+// with the version in storage
+var (
+	conflictMarkerMine      = "<<<<<<< yours"
+	conflictMarkerBase      = "||||||| original"
+	conflictMarkerSeparator = "======="
+	conflictMarkerTheirs    = ">>>>>>> theirs"
+	conflictMarkersRe       = regexp.MustCompile(`(?m)^(<<<<<<<|\|\|\|\|\|\|\||=======|>>>>>>>)`)
+)
+
 // regexes to lookup title, tags and sticky attribute
 var (
 	noteTitleRe  = regexp.MustCompile(prnt.Sprintf(`\n*%v *(.+)\n`, noteTitleMarker))
@@ -38,15 +50,24 @@ var (
 // new commands can be implemented by writing a function and adding it to this map
 var (
 	knownCommands = map[string]func(notepet.Storage, *notepetConfig) error{
-		"show":   processShowCommand,
-		"put":    processPutCommand,
-		"new":    processNewCommand,
-		"sticky": processStickyCommand,
-		"del":    processDelCommand,
-		"edit":   processEditCommand,
-		"search": processSearchCommand,
-		"export": processExportCommand,
-		"shell":  processShellCommand,
+		"show":     processShowCommand,
+		"put":      processPutCommand,
+		"new":      processNewCommand,
+		"sticky":   processStickyCommand,
+		"del":      processDelCommand,
+		"edit":     processEditCommand,
+		"search":   processSearchCommand,
+		"export":   processExportCommand,
+		"history":  processHistoryCommand,
+		"restore":  processRestoreCommand,
+		"tags":     processTagsCommand,
+		"trash":    processTrashCommand,
+		"undelete": processUndeleteCommand,
+		"shell":    processShellCommand,
+		"sync":     processSyncCommand,
+		"watch":    processWatchCommand,
+		"share":    processShareCommand,
+		"unshare":  processUnshareCommand,
 	}
 )
 
@@ -67,15 +88,49 @@ func runCLI(st notepet.Storage, conf *notepetConfig) error {
 }
 
 func processShowCommand(st notepet.Storage, conf *notepetConfig) error {
-	notes, err := st.Get()
-	if len(notes) == 0 {
-		return prnt.Errorf("no notes found: %v", err)
+	opts := notepet.ListOptions{Sort: conf.sort}
+	slicearg := flag.Arg(1)
+	switch flag.Arg(1) {
+	case "--tag", "-tag", "--any-tag", "-any-tag":
+		opts.AllTags = !strings.Contains(flag.Arg(1), "any")
+		opts.Tags = notepet.ParseTags(flag.Arg(2))
+		slicearg = flag.Arg(3)
+	}
+	// learn total number of notes first to resolve slice
+	// like -3: and then fetch only requested notes
+	probe := opts
+	probe.Limit = 1
+	page, err := notepet.List(st, probe)
+	if err != nil {
+		return err
 	}
-	start, end, err := parseSliceArg(flag.Arg(1), len(notes))
+	total := page.Total
+	var all []notepet.Note
+	if total == 0 && len(page.Notes) > 0 {
+		// server did not report total number of notes (earlier
+		// versions do not) so fetch all of them and count
+		if page, err = notepet.List(st, opts); err != nil {
+			return err
+		}
+		all, total = page.Notes, len(page.Notes)
+	}
+	if total == 0 {
+		return prnt.Errorf("no notes found: %v", notepet.ErrNoNotesFound)
+	}
+	start, end, err := parseSliceArg(slicearg, total)
 	if err != nil {
 		return prnt.Use("error").Errorf("%v", err)
 	}
-	notes = notes[start:end]
+	notes := all
+	if notes != nil {
+		notes = notes[start:end]
+	} else {
+		opts.Offset, opts.Limit = start, end-start
+		if page, err = notepet.List(st, opts); err != nil {
+			return err
+		}
+		notes = page.Notes
+	}
 	for _, note := range notes {
 		prnt.Use("header").Print(start+1, " ")
 		// note.ID = notepet.NoteID(prnt.Sprintf("%v", start+1))
@@ -118,38 +173,32 @@ func processNewCommand(st notepet.Storage, conf *notepetConfig) error {
 }
 
 func processStickyCommand(st notepet.Storage, conf *notepetConfig) error {
-	index, err := strconv.Atoi(flag.Arg(1))
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
 	if err != nil {
-		return prnt.Errorf("invalid index")
-	}
-	notes, _ := st.Get()
-	if index-1 < 0 || index-1 >= len(notes) {
-		return prnt.Errorf("invalid index")
+		return err
 	}
-	note := notes[index-1]
-	note.Sticky = !note.Sticky
-	id, err := st.Upd(note.ID, note)
+	sticky := !note.Sticky
+	id, err := notepet.PatchNote(st, note.ID, notepet.NotePatch{Sticky: &sticky})
 	if err == nil {
-		prnt.Printf("Set STICKY mode for ID %v to %v\n", id, note.Sticky)
+		prnt.Printf("Set STICKY mode for ID %v to %v\n", id, sticky)
 	}
 	return err
 }
 
 func processDelCommand(st notepet.Storage, conf *notepetConfig) error {
-	index, err := strconv.Atoi(flag.Arg(1))
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
 	if err != nil {
-		return prnt.Errorf("invalid index")
-	}
-	notes, _ := st.Get()
-	if index-1 < 0 || index-1 >= len(notes) {
-		return prnt.Errorf("invalid index")
+		return err
 	}
-	note := notes[index-1]
 	printNote(note, conf)
 	if !promptUserYorN("Delete this note?") {
 		return nil
 	}
-	err = st.Del(note.ID)
+	if cu, ok := st.(notepet.ConditionalUpdater); ok {
+		err = cu.DelIfMatch(note.ID, note.ETag())
+	} else {
+		err = st.Del(note.ID)
+	}
 	if err == nil {
 		prnt.Printf("Successfully deleted note with id %v\n", note.ID)
 	}
@@ -157,49 +206,313 @@ func processDelCommand(st notepet.Storage, conf *notepetConfig) error {
 }
 
 func processEditCommand(st notepet.Storage, conf *notepetConfig) error {
-	index, err := strconv.Atoi(flag.Arg(1))
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
 	if err != nil {
-		return prnt.Errorf("invalid index")
-	}
-	notes, _ := st.Get()
-	if index-1 < 0 || index-1 >= len(notes) {
-		return prnt.Errorf("invalid index")
+		return err
 	}
-	note := notes[index-1]
 	oldID := note.ID
 	printNote(note, conf)
 	if !promptUserYorN("Edit this note?") {
 		return nil
 	}
-	note, err = editNote(note, conf)
+	edited, err := editNote(note, conf)
 	if err != nil {
 		prnt.Println("Could not edit note.")
 		return err
 	}
 	prnt.Println("Sucessfully edited note.")
-	newID, err := st.Upd(oldID, note)
-	if err == nil {
-		prnt.Printf("Sucessfully replaced note with id %v.\n", newID)
+	cu, ok := st.(notepet.ConditionalUpdater)
+	if !ok {
+		newID, err := st.Upd(oldID, edited)
+		if err == nil {
+			prnt.Printf("Sucessfully replaced note with id %v.\n", newID)
+		}
+		return err
+	}
+	base := note
+	for {
+		newID, err := cu.UpdIfMatch(oldID, edited, base.ETag())
+		if _, conflict := err.(*notepet.ConflictError); !conflict {
+			if err == nil {
+				prnt.Printf("Sucessfully replaced note with id %v.\n", newID)
+			}
+			return err
+		}
+		current, err := st.Get(oldID)
+		if err != nil || len(current) == 0 {
+			return prnt.Errorf("note has been deleted while you were editing it")
+		}
+		prnt.Println("Note has been modified by someone else while you were editing it.")
+		if !promptUserYorN("Open editor to merge the changes?") {
+			return prnt.Errorf("note was not saved")
+		}
+		edited, err = editConflict(base, edited, current[0], conf)
+		if err != nil {
+			prnt.Println("Could not edit note.")
+			return err
+		}
+		base = current[0]
 	}
-	return err
 }
 
 func processSearchCommand(st notepet.Storage, conf *notepetConfig) error {
-	stringToFind := flag.Arg(1)
-	notes, err := st.Search(stringToFind)
+	query := strings.Join(flag.Args()[1:], " ")
+	results, err := notepet.SearchRanked(st, query)
 	if err != nil {
 		return err
 	}
-	for _, note := range notes {
-		printNote(note, conf)
+	for _, result := range results {
+		if result.Snippet != "" && conf.verbose {
+			snippet := strings.NewReplacer(
+				notepet.SnippetMarkStart, "",
+				notepet.SnippetMarkEnd, "").Replace(result.Snippet)
+			prnt.Use("tags").Println("Match:\t\t" + snippet)
+		}
+		printNote(result.Note, conf)
 	}
 	return nil
 }
 
 func processExportCommand(st notepet.Storage, conf *notepetConfig) error {
-	data, err := notepet.ExportJSON(st)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	switch flag.Arg(1) {
+	case "--ndjson", "-ndjson":
+		return notepet.ExportNDJSON(out, st)
+	}
+	if err := notepet.ExportJSONTo(out, st); err != nil {
+		return err
+	}
+	_, err := out.WriteString("\n")
+	return err
+}
+
+func processSyncCommand(st notepet.Storage, conf *notepetConfig) error {
+	replica, ok := st.(*notepet.Replica)
+	if !ok {
+		var err error
+		if replica, err = notepet.OpenSQLiteReplica(conf.replica, st); err != nil {
+			return err
+		}
+		defer replica.Close()
+	}
+	report, err := replica.Sync()
+	if err != nil && len(report.Pulled)+len(report.Pushed)+len(report.DeletedLocal)+len(report.DeletedRemote)+len(report.Conflicts) == 0 {
+		return err
+	}
+	prnt.Printf("pulled: %d, pushed: %d, deleted locally: %d, deleted on server: %d, conflicts: %d\n",
+		len(report.Pulled), len(report.Pushed), len(report.DeletedLocal), len(report.DeletedRemote), len(report.Conflicts))
+	if len(report.Conflicts) > 0 {
+		prnt.Println("Notes edited both locally and on server now have server version, local versions were added as conflict copies.")
+	}
+	return err
+}
+
+// watchRetryInterval is pause before reconnecting to server after
+// watch command has lost connection.
+var watchRetryInterval = 5 * time.Second
+
+func processWatchCommand(st notepet.Storage, conf *notepetConfig) error {
+	w, ok := st.(interface {
+		Watch(func(notepet.Event) error) error
+	})
+	if !ok {
+		return prnt.Errorf("watch needs connection to server")
+	}
+	prnt.Println("Watching for changes of notes. Press Ctrl+C to stop.")
+	for {
+		err := w.Watch(func(e notepet.Event) error {
+			prnt.Use("header").Printf("%v note %v %v\n", e.Time.Format("15:04:05"), e.ID, e.Type)
+			if e.Note != nil && e.Type != notepet.EventSticky {
+				printNote(*e.Note, conf)
+			}
+			return nil
+		})
+		if err != nil {
+			prnt.Printf("connection lost: %v\n", err)
+		}
+		time.Sleep(watchRetryInterval)
+	}
+}
+
+func processHistoryCommand(st notepet.Storage, conf *notepetConfig) error {
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
+	if err != nil {
+		return err
+	}
+	hs, ok := st.(notepet.HistoryStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep history")
+	}
+	revs, err := hs.History(note.ID)
+	if err != nil {
+		return err
+	}
+	if len(revs) == 0 {
+		prnt.Println("Note has not been edited.")
+		return nil
+	}
+	for _, rev := range revs {
+		prnt.Use("header").Printf("rev %v ", rev.Rev)
+		printNote(revisionToNote(rev), conf)
+	}
+	return nil
+}
+
+func processRestoreCommand(st notepet.Storage, conf *notepetConfig) error {
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
+	if err != nil {
+		return err
+	}
+	rev, err := strconv.Atoi(flag.Arg(2))
+	if err != nil {
+		return prnt.Errorf("invalid revision")
+	}
+	hs, ok := st.(notepet.HistoryStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep history")
+	}
+	revision, err := hs.Revision(note.ID, rev)
+	if err != nil {
+		return err
+	}
+	printNote(revisionToNote(revision), conf)
+	if !promptUserYorN("Restore this revision?") {
+		return nil
+	}
+	id, err := notepet.RestoreRevision(st, note.ID, rev)
+	if err == nil {
+		prnt.Printf("Restored revision %v of note with id %v\n", rev, id)
+	}
+	return err
+}
+
+func processTagsCommand(st notepet.Storage, conf *notepetConfig) error {
+	var counts []notepet.TagCount
+	var err error
+	if ts, ok := st.(notepet.TagStorage); ok {
+		counts, err = ts.Tags()
+	} else {
+		notes, _ := st.Get()
+		counts = notepet.CountTags(notes)
+	}
+	if err != nil {
+		return err
+	}
+	if len(counts) == 0 {
+		prnt.Println("No tags found.")
+		return nil
+	}
+	for _, tc := range counts {
+		prnt.Use("tags").Print(tc.Tag)
+		prnt.Printf(" %v\n", tc.Count)
+	}
+	return nil
+}
+
+func processTrashCommand(st notepet.Storage, conf *notepetConfig) error {
+	ts, ok := st.(notepet.TrashStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep trash")
+	}
+	if flag.Arg(1) == "empty" {
+		if !promptUserYorN("Permanently remove all notes from trash?") {
+			return nil
+		}
+		n, err := ts.EmptyTrash(time.Now())
+		if err == nil {
+			prnt.Printf("Removed %v notes from trash\n", n)
+		}
+		return err
+	}
+	notes, err := ts.Trash()
+	if err != nil {
+		return err
+	}
+	if len(notes) == 0 {
+		prnt.Println("Trash is empty.")
+		return nil
+	}
+	for i, note := range notes {
+		prnt.Use("header").Printf("%v deleted %v ", i+1, note.Deleted.Format("02/01/2006 15:04:05"))
+		printNote(note.Note, conf)
+	}
+	return nil
+}
+
+func processShareCommand(st notepet.Storage, conf *notepetConfig) error {
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
+	if err != nil {
+		return err
+	}
+	ss, ok := st.(notepet.ShareStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep shares")
+	}
+	if flag.Arg(2) == "" {
+		shares, err := ss.Shares(note.ID)
+		if err != nil {
+			return err
+		}
+		if len(shares) == 0 {
+			prnt.Println("Note is not shared.")
+			return nil
+		}
+		for _, s := range shares {
+			prnt.Printf("%v\t%v\n", s.Grantee, s.Access)
+		}
+		return nil
+	}
+	share := notepet.Share{ID: note.ID, Grantee: flag.Arg(2), Access: notepet.AccessRead}
+	if flag.Arg(3) != "" {
+		share.Access = strings.ToLower(flag.Arg(3))
+	}
+	if err := ss.Share(share); err != nil {
+		return err
+	}
+	prnt.Printf("Shared note with id %v with %v (%v)\n", note.ID, share.Grantee, share.Access)
+	return nil
+}
+
+func processUnshareCommand(st notepet.Storage, conf *notepetConfig) error {
+	note, err := getNoteByIndex(st, flag.Arg(1), conf)
+	if err != nil {
+		return err
+	}
+	ss, ok := st.(notepet.ShareStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep shares")
+	}
+	if flag.Arg(2) == "" {
+		return prnt.Errorf("user or @group to unshare note with is required")
+	}
+	if err := ss.Unshare(note.ID, flag.Arg(2)); err != nil {
+		return err
+	}
+	prnt.Printf("Unshared note with id %v with %v\n", note.ID, flag.Arg(2))
+	return nil
+}
+
+func processUndeleteCommand(st notepet.Storage, conf *notepetConfig) error {
+	ts, ok := st.(notepet.TrashStorage)
+	if !ok {
+		return prnt.Errorf("storage does not keep trash")
+	}
+	index, err := strconv.Atoi(flag.Arg(1))
+	if err != nil {
+		return prnt.Errorf("invalid index")
+	}
+	notes, err := ts.Trash()
+	if err != nil {
+		return err
+	}
+	if index-1 < 0 || index-1 >= len(notes) {
+		return prnt.Errorf("invalid index")
+	}
+	note := notes[index-1]
+	err = ts.Undelete(note.ID)
 	if err == nil {
-		prnt.Println(string(data))
+		prnt.Printf("Restored note with id %v from trash\n", note.ID)
 	}
 	return err
 }
@@ -210,6 +523,33 @@ func processShellCommand(st notepet.Storage, conf *notepetConfig) error {
 	return nil
 }
 
+// getNoteByIndex fetches note with index (starting from 1) shown by show command
+func getNoteByIndex(st notepet.Storage, arg string, conf *notepetConfig) (notepet.Note, error) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return notepet.Note{}, prnt.Errorf("invalid index")
+	}
+	if index < 1 {
+		return notepet.Note{}, prnt.Errorf("invalid index")
+	}
+	page, _ := notepet.List(st, notepet.ListOptions{Sort: conf.sort, Offset: index - 1, Limit: 1})
+	if len(page.Notes) == 0 {
+		return notepet.Note{}, prnt.Errorf("invalid index")
+	}
+	return page.Notes[0], nil
+}
+
+func revisionToNote(rev notepet.Revision) notepet.Note {
+	return notepet.Note{
+		ID:         rev.ID,
+		Title:      rev.Title,
+		Body:       rev.Body,
+		Tags:       rev.Tags,
+		Sticky:     rev.Sticky,
+		LastEdited: rev.LastEdited,
+	}
+}
+
 func editNewNote(conf *notepetConfig) (note notepet.Note, err error) {
 	note.Title = " "
 	note.Tags = " "
@@ -218,30 +558,59 @@ func editNewNote(conf *notepetConfig) (note notepet.Note, err error) {
 }
 
 func editNote(n notepet.Note, conf *notepetConfig) (note notepet.Note, err error) {
-	tmpFile, err := createTempFile()
+	text, err := editText(convertNoteToEditableString(n), conf)
 	if err != nil {
 		return
 	}
+	return convertStringToNote(text), nil
+}
+
+// editConflict opens editor with three versions of note: edited by user,
+// the one user's edit is based on and the current one from storage. The
+// user is asked to edit again until all conflict markers are removed.
+func editConflict(base, mine, theirs notepet.Note, conf *notepetConfig) (note notepet.Note, err error) {
+	text := conflictMarkerMine + "\n" + convertNoteToEditableString(mine) +
+		conflictMarkerBase + "\n" + convertNoteToEditableString(base) +
+		conflictMarkerSeparator + "\n" + convertNoteToEditableString(theirs) +
+		conflictMarkerTheirs + " (edited " + theirs.LastEdited.Format("02/01/2006 15:04:05") + ")\n"
+	for {
+		if text, err = editText(text, conf); err != nil {
+			return
+		}
+		if !conflictMarkersRe.MatchString(text) {
+			return convertStringToNote(text), nil
+		}
+		if !promptUserYorN("Note still contains conflict markers. Edit again?") {
+			return note, prnt.Errorf("conflict has not been resolved")
+		}
+	}
+}
+
+// editText opens text in editor and returns the edited text
+func editText(text string, conf *notepetConfig) (string, error) {
+	tmpFile, err := createTempFile()
+	if err != nil {
+		return "", err
+	}
 	defer os.Remove(tmpFile.Name())
 	// defer tmpFile.Close()
 	// TODO: Handle errors here ?
-	notebytes := []byte(convertNoteToEditableString(n))
-	tmpFile.Write(notebytes)
+	tmpFile.Write([]byte(text))
 	tmpFile.Close() // Closing and reopening (keep file open and use Seek(0, 0)?)
 	err = runEditor(tmpFile.Name(), conf.editor)
 	if err != nil {
-		return
+		return "", err
 	}
 	tmpFile, err = os.Open(tmpFile.Name())
 	if err != nil {
-		return
+		return "", err
 	}
 	defer tmpFile.Close()
 	data, err := ioutil.ReadAll(tmpFile)
 	if err != nil {
-		return
+		return "", err
 	}
-	return convertStringToNote(string(data)), nil
+	return string(data), nil
 }
 
 func convertNoteToEditableString(n notepet.Note) (output string) {
@@ -319,6 +688,9 @@ func printNoteVerbose(note notepet.Note) {
 	if note.Tags != "" {
 		out += prnt.Sprint("Tags:\t\t") + prnt.Use("tags").Sprint(note.Tags) + "\n"
 	}
+	if note.Owner != "" {
+		out += prnt.Sprintf("Owner:\t\t%v\n", note.Owner)
+	}
 	prnt.Println(out)
 }
 
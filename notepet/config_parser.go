@@ -12,6 +12,9 @@ type notepetConfig struct {
 	port    string
 	path    string
 	token   string
+	sort    string
+	replica string // local copy of notes used by sync and offline mode
+	offline bool
 }
 
 func readAndParseConfig(filename string) *notepetConfig {
@@ -29,5 +32,8 @@ func readAndParseConfig(filename string) *notepetConfig {
 	config.verbose = parsed.HasOption("verbose")
 	config.color = parsed.HasOption("color")
 	config.path = parsed.Get("path").String()
+	config.sort = parsed.Get("sort").String()
+	config.replica = parsed.Get("replica").String()
+	config.offline = parsed.HasOption("offline")
 	return &config
 }
@@ -19,23 +19,45 @@ var prnt = termtools.PrintSuite{}
 func displayHelpLong() { //TODO: write proper help
 	name := os.Args[0]
 	prnt.Printf(`Usage: %v <options> <command> <arguments>
-  Commands are: show, put, new, sticky, del, edit, search, export
+  Commands are: show, put, new, sticky, del, edit, search, export, history, restore,
+    tags, trash, undelete, sync, watch, share, unshare
 	
   Example: 
   Argument to get and del commands is index of Note to printout or delete
   show shows all notes and their indices
-  search looks up the input string and returns matching results
+  search looks up notes matching query and returns matching results
   Example: 
 	%v show returns all notes in storage. You can provide a single index
 	   or slice. show 3 - will show note No 3. show 2: will show all notes
 	   starting from 2. show :4 will show first four note inclusive.	
+	%v show --tag go,ops 1:5 shows notes marked with both tags "go" and "ops",
+	   show --any-tag go,ops shows notes marked with either of them.
+	%v -sort title show 1:10 shows first ten notes sorted by title. Only
+	   requested notes are fetched from server.
+	%v export prints all notes as JSON, export --ndjson prints one note
+	   per line.
+	%v tags lists all tags with number of notes marked with each.
+	%v search title:deploy tag:ops -tag:old edited:>2026-01-01 '"exact phrase"'
+	   shows notes matching all terms, terms may be joined with OR.
 	%v put "Hello" "Hello world" "tag1 tag2" - adds note with title
 	   "Hello", body "Hello world" and two tags. IF only one argument is 
 	   present after put command it will be considered the body of note.
 	%v del 1 - deletes note with index 1
+	%v history 1 - shows previous revisions of note with index 1
+	%v restore 1 2 - restores revision 2 of note with index 1
+	%v trash - shows deleted notes, trash empty - removes them permanently
+	%v undelete 1 - restores note with index 1 in trash
+	%v sync - synchronizes local replica of notes with server. Then
+	   %v -offline show works without server. Changes made offline
+	   are sent to server by the next sync.
+	%v watch - prints notes as soon as they are added, changed or
+	   deleted by anyone until interrupted with Ctrl+C.
+	%v share 1 bob rw - lets user bob read and edit note with index 1,
+	   share 1 @devops lets group devops read it, share 1 lists shares.
+	%v unshare 1 bob - revokes access of bob to note with index 1
   
   Options:
-`, name, name, name, name)
+`, name, name, name, name, name, name, name, name, name, name, name, name, name, name, name, name, name, name)
 	flag.PrintDefaults()
 }
 
@@ -50,6 +72,9 @@ func main() {
 		flagIP         = flag.String("ip", "", "ip address to connect to")
 		flagPort       = flag.String("port", "", "port to connect to")
 		flagAPIpath    = flag.String("path", "", "api base path")
+		flagSort       = flag.String("sort", "", "order of notes: sticky-first, created, lastedited or title")
+		flagOffline    = flag.Bool("offline", false, "work with local replica of notes without connecting to server")
+		flagReplica    = flag.String("replica", "", "local replica of notes to use by sync command and in offline mode")
 		// flagUpdateIDs  = flag.Bool("generate", false, "recalculate IDs of all notes")
 	)
 	flag.Usage = displayHelpLong
@@ -79,12 +104,33 @@ func main() {
 	if *flagAPIpath != "" {
 		conf.path = *flagAPIpath
 	}
+	if *flagSort != "" {
+		conf.sort = *flagSort
+	}
+	if *flagOffline {
+		conf.offline = *flagOffline
+	}
+	if *flagReplica != "" {
+		conf.replica = *flagReplica
+	}
+	if conf.replica == "" {
+		conf.replica = filepath.Join(homedir, ".notepet-replica.db")
+	}
 	storage, err := notepet.NewAPIClient(conf.server, conf.port, conf.path, conf.token)
 	if err != nil {
 		prnt.Printf("error initializing api client: %v", err)
 		return
 	}
 	defer storage.Close()
+	if conf.offline {
+		replica, err := notepet.OpenSQLiteReplica(conf.replica, storage)
+		if err != nil {
+			prnt.Printf("error opening local replica: %v", err)
+			return
+		}
+		defer replica.Close()
+		storage = replica
+	}
 
 	if err := runCLI(storage, conf); err != nil {
 		prnt.Println(err)
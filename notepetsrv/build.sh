@@ -0,0 +1,3 @@
+go build -tags sqlite_fts5 -o notepetsrv
+sudo cp notepetsrv /usr/local/bin
+echo 'notepetsrv reinstalled'
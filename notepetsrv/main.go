@@ -3,9 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/dmfed/notepet"
 )
@@ -14,24 +17,48 @@ const version string = `notepetsrv v0.1.0
 Copyright 2021 by Dmitry Fedotov
 Redistributable under MIT license`
 
-// ReadTokensFile accepts filename to parse. It reads
-// file and adds each non-empty line found as token.
-func readTokensFromFile(filename string) (tokens []string, err error) {
-	data, err := os.ReadFile(filename)
-	tokens = []string{}
-	if err != nil {
-		return
-	}
-	for _, line := range strings.Split(string(data), "\n") {
-		if strings.HasPrefix(line, "#") {
-			continue
+// purgeTrash periodically removes notes which have been
+// in trash for longer than retention.
+func purgeTrash(st notepet.Storage, retention, interval time.Duration) {
+	for {
+		if n, err := notepet.PurgeTrash(st, retention); err != nil {
+			log.Printf("error purging trash: %v\n", err)
+		} else if n > 0 {
+			log.Printf("purged %v notes from trash\n", n)
 		}
-		line = strings.Trim(line, " \n")
-		if line != "" {
-			tokens = append(tokens, line)
+		time.Sleep(interval)
+	}
+}
+
+// watchTokens reloads tokens on SIGHUP and periodically saves
+// last used times of tokens unless file holds plain tokens.
+func watchTokens(tokens *notepet.TokenStore, interval time.Duration) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hangups:
+			if err := tokens.Reload(); err != nil {
+				log.Printf("error reloading tokens: %v\n", err)
+			} else {
+				log.Printf("tokens reloaded")
+			}
+		case <-ticker.C:
+			saveTokens(tokens)
 		}
 	}
-	return
+}
+
+// saveTokens saves last used times of tokens unless file holds plain tokens
+func saveTokens(tokens *notepet.TokenStore) {
+	if tokens.Legacy() {
+		return
+	}
+	if err := tokens.Save(); err != nil {
+		log.Printf("error saving tokens: %v\n", err)
+	}
 }
 
 func main() {
@@ -43,6 +70,15 @@ func main() {
 		flagCertFile    = flag.String("cert", "", "certificate file to use")
 		flagKeyFile     = flag.String("key", "", "key file to use")
 		flagAppToken    = flag.String("t", "", "provide app token via command line")
+		flagWeb         = flag.Bool("web", false, "serve web interface under /notes")
+		flagRetention   = flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted notes are kept in trash (0 keeps them forever)")
+		flagIDs         = flag.String("ids", "ulid", "IDs of new notes: ulid or sha256 (as in earlier versions)")
+		flagWebhooks    = flag.String("webhooks", "", "file with webhooks receiving events of notes")
+		flagWebhookLog  = flag.String("webhook-log", "", "file to write log of webhook deliveries to")
+		flagJWTKeys     = flag.String("jwt-keys", "", "JWKS or PEM file with keys of identity provider to accept bearer JWTs")
+		flagJWTIssuer   = flag.String("jwt-issuer", "", "issuer of accepted JWTs (required with -jwt-keys)")
+		flagJWTAudience = flag.String("jwt-audience", "", "audience of accepted JWTs (required with -jwt-keys)")
+		flagJWTUser     = flag.String("jwt-user-claim", "sub", "claim of JWT holding user name")
 		flagVersion     = flag.Bool("v", false, "print version and exit")
 	)
 	flag.Parse()
@@ -52,6 +88,31 @@ func main() {
 		return
 	}
 
+	if flag.Arg(0) == "token" {
+		if err := runTokenCommand(*flagTokensFile, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch *flagIDs {
+	case "ulid":
+		notepet.SetIDGenerator(notepet.ULIDGenerator)
+	case "sha256":
+		notepet.SetIDGenerator(notepet.SHA256Generator)
+	default:
+		log.Printf("unknown type of IDs: %v exiting", *flagIDs)
+		return
+	}
+
+	// JWTs of any issuer and audience signed with the keys would be
+	// accepted otherwise, e.g. tokens issued for other applications
+	if *flagJWTKeys != "" && (*flagJWTIssuer == "" || *flagJWTAudience == "") {
+		log.Printf("-jwt-keys requires -jwt-issuer and -jwt-audience exiting")
+		return
+	}
+
 	// Open storage
 	var st notepet.Storage
 	st, err := notepet.OpenSQLiteStorage(*flagStorageFile)
@@ -60,19 +121,75 @@ func main() {
 		return
 	}
 
+	// Purge old notes from trash
+	if *flagRetention > 0 {
+		go purgeTrash(st, *flagRetention, time.Hour)
+	}
+
 	// Get tokens
-	var tokens = []string{}
+	tokens := notepet.NewTokenStore()
 	if *flagTokensFile != "" {
-		if tks, err := readTokensFromFile(*flagTokensFile); err == nil {
-			tokens = append(tokens, tks...)
+		tokens, err = notepet.OpenTokenStore(*flagTokensFile)
+		if err != nil {
+			log.Printf("could not read tokens: %v exiting", err)
+			st.Close()
+			return
+		}
+		if tokens.Legacy() {
+			log.Printf("tokens file holds plain tokens, run notepetsrv token list to hash them")
 		}
+		go watchTokens(tokens, time.Minute)
 	}
+
+	// Configure the server
+	apihandler, err := notepet.NewAPIHandler(st)
+	if err != nil {
+		st.Close()
+		return
+	}
+	apihandler.Tokens = tokens
 	if *flagAppToken != "" {
-		tokens = append(tokens, *flagAppToken)
+		apihandler.RegisterToken(*flagAppToken)
 	}
 
-	// Configure the server
-	srv, err := notepet.NewNotepetServer(*flagIPAddr, *flagPort, st, false, tokens...)
+	// Accept JWTs issued by identity provider
+	if *flagJWTKeys != "" {
+		keys, err := notepet.ReadJWTKeys(*flagJWTKeys)
+		if err != nil {
+			log.Printf("could not read JWT keys: %v exiting", err)
+			st.Close()
+			return
+		}
+		jwtauth := notepet.NewJWTAuthenticator(keys, *flagJWTIssuer, *flagJWTAudience)
+		jwtauth.UserClaim = *flagJWTUser
+		apihandler.Auth = notepet.Authenticators{tokens, jwtauth}
+	}
+
+	// Send events of notes to webhooks
+	if *flagWebhooks != "" {
+		hooks, err := notepet.ReadWebhooksFile(*flagWebhooks)
+		if err != nil {
+			log.Printf("could not read webhooks: %v exiting", err)
+			st.Close()
+			return
+		}
+		var deliverylog io.Writer
+		if *flagWebhookLog != "" {
+			f, err := os.OpenFile(*flagWebhookLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				log.Printf("could not open webhook delivery log: %v exiting", err)
+				st.Close()
+				return
+			}
+			defer f.Close()
+			deliverylog = f
+		}
+		events, cancel := apihandler.Events.Subscribe(256)
+		defer cancel()
+		go notepet.NewWebhookDispatcher(hooks, deliverylog).Run(events)
+	}
+
+	srv, err := notepet.NewNotepetServerWithHandler(*flagIPAddr, *flagPort, apihandler, *flagWeb)
 	if err != nil {
 		st.Close()
 		return
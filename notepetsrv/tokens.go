@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dmfed/notepet"
+)
+
+const tokenUsage = `Usage: notepetsrv [-tokens file] token <command> <arguments>
+  create [-label text] [-role user|admin] [-groups g1,g2] [-scopes s1,s2] [-expires when] [user]
+	creates token and prints it. Token without user is admin token.
+	Scopes are notes:read, notes:write, notes:delete and admin (all by default).
+  list	lists tokens (tokens themselves are not kept, only their hashes)
+  revoke <id>	removes token with id
+  expire <id> [when]	makes token expire at when (now by default)
+  when is duration from now (e.g. 720h), date (YYYY-MM-DD) or RFC3339 time.
+  Running notepetsrv gets changes on SIGHUP.`
+
+// runTokenCommand manages tokens kept in filename. Files holding plain
+// tokens are rewritten with hashes first.
+func runTokenCommand(filename string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+	tokens, err := notepet.OpenTokenStore(filename)
+	if err != nil {
+		return err
+	}
+	if tokens.Legacy() {
+		if err := tokens.Save(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "plain tokens in %v have been replaced with hashes\n", filename)
+	}
+	switch args[0] {
+	case "create":
+		return createToken(tokens, args[1:])
+	case "list":
+		return listTokens(tokens)
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(tokenUsage)
+		}
+		return tokens.Revoke(args[1])
+	case "expire":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New(tokenUsage)
+		}
+		at := time.Now()
+		if len(args) == 3 {
+			if at, err = parseWhen(args[2]); err != nil {
+				return err
+			}
+		}
+		return tokens.Expire(args[1], at)
+	}
+	return errors.New(tokenUsage)
+}
+
+func createToken(tokens *notepet.TokenStore, args []string) error {
+	fs := flag.NewFlagSet("token create", flag.ContinueOnError)
+	var (
+		label   = fs.String("label", "", "label of token (e.g. what it is used by)")
+		role    = fs.String("role", "", "role of user: user or admin (default user, admin if there is no user)")
+		groups  = fs.String("groups", "", "comma separated groups of user")
+		scopes  = fs.String("scopes", "", "comma separated scopes granted by token (all by default)")
+		expires = fs.String("expires", "", "when token expires (never by default)")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	u := notepet.User{Name: fs.Arg(0), Role: *role}
+	if !notepet.ValidUserName(u.Name) {
+		return fmt.Errorf("invalid user name %q: must not start with %q", u.Name, notepet.GroupPrefix)
+	}
+	if u.Role == "" {
+		u.Role = notepet.RoleUser
+		if u.Name == "" {
+			u.Role = notepet.RoleAdmin
+		}
+	}
+	if u.Role != notepet.RoleUser && u.Role != notepet.RoleAdmin {
+		return fmt.Errorf("invalid role %q", u.Role)
+	}
+	if u.Name == "" && !u.IsAdmin() {
+		return fmt.Errorf("token of user without admin role needs user name")
+	}
+	if *groups != "" {
+		u.Groups = strings.Split(*groups, ",")
+	}
+	scopelist, err := notepet.ParseScopes(*scopes)
+	if err != nil {
+		return err
+	}
+	u.Scopes = scopelist
+	var at time.Time
+	if *expires != "" {
+		if at, err = parseWhen(*expires); err != nil {
+			return err
+		}
+	}
+	token, t, err := tokens.Create(*label, u, at)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created token with id %v:\n%v\n", t.ID, token)
+	return nil
+}
+
+func listTokens(tokens *notepet.TokenStore) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLABEL\tUSER\tROLE\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+	now := time.Now()
+	for _, t := range tokens.List() {
+		expires := "never"
+		if t.Expired(now) {
+			expires = "expired"
+		} else if !t.Expires.IsZero() {
+			expires = formatTime(t.Expires)
+		}
+		lastused := "never"
+		if !t.LastUsed.IsZero() {
+			lastused = formatTime(t.LastUsed)
+		}
+		scopes := "all"
+		if len(t.User.Scopes) > 0 {
+			scopes = strings.Join(t.User.Scopes, ",")
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", t.ID, t.Label, t.User.Name, t.User.Role, scopes, formatTime(t.Created), expires, lastused)
+	}
+	return w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04")
+}
+
+// parseWhen parses duration from now, date or RFC3339 time
+func parseWhen(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want duration, YYYY-MM-DD or RFC3339", s)
+}
@@ -29,6 +29,9 @@ type Note struct {
 	Sticky     bool      `json:"sticky,omitempty"`
 	TimeStamp  time.Time `json:"timestamp,omitempty"`
 	LastEdited time.Time `json:"lastedited,omitempty"`
+	// Owner is name of user who has created the note. Notes
+	// added before there were users have no owner.
+	Owner string `json:"owner,omitempty"`
 }
 
 func (n Note) String() (out string) {
@@ -47,6 +50,14 @@ func (n Note) String() (out string) {
 	return
 }
 
+// ETag returns version tag of the note. The tag changes each time
+// the note is modified and is used by server and client to detect
+// concurrent modifications.
+func (n Note) ETag() string {
+	sum := sha256.Sum256([]byte(n.ID.String() + n.LastEdited.UTC().Format(time.RFC3339Nano)))
+	return fmt.Sprintf("\"%x\"", sum[:8])
+}
+
 func sortNotes(notes []Note) {
 	sort.Slice(notes, func(i, j int) bool {
 		if notes[i].Sticky && notes[j].Sticky {
@@ -60,14 +71,6 @@ func sortNotes(notes []Note) {
 	})
 }
 
-func generateID(n Note) NoteID {
-	sum := sha256.New()
-	sum.Write([]byte(n.Title))
-	sum.Write([]byte(n.TimeStamp.String()))
-	s := string(sum.Sum(nil))
-	return NoteID(fmt.Sprintf("%x", s))
-}
-
 func noteToBytes(n Note) []byte {
 	data, _ := json.MarshalIndent(n, "", "    ")
 	return data
@@ -1,6 +1,7 @@
 package notepet
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -8,9 +9,9 @@ import (
 
 func TestHashGenerator(t *testing.T) {
 	stamp := time.Now()
-	h1 := generateID(Note{Title: "hello", TimeStamp: stamp})
-	h2 := generateID(Note{Title: "hello", TimeStamp: time.Now()})
-	h3 := generateID(Note{Title: "hello", TimeStamp: stamp})
+	h1 := SHA256Generator.NewID(Note{Title: "hello", TimeStamp: stamp})
+	h2 := SHA256Generator.NewID(Note{Title: "hello", TimeStamp: time.Now()})
+	h3 := SHA256Generator.NewID(Note{Title: "hello", TimeStamp: stamp})
 	if h1 == h2 {
 		fmt.Println("hash is not unique")
 		t.Fail()
@@ -20,3 +21,89 @@ func TestHashGenerator(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestULIDGenerator(t *testing.T) {
+	stamp := time.Now()
+	prev := generateID(Note{TimeStamp: stamp.Add(-time.Second)})
+	for i := 0; i < 1000; i++ {
+		// untitled notes created in the same clock tick used to collide
+		id := generateID(Note{TimeStamp: stamp})
+		if len(id) != 26 || !ValidNoteID(id) || id <= prev {
+			fmt.Println("ULIDs should be unique and sorted:", prev, id)
+			t.FailNow()
+		}
+		prev = id
+	}
+	if got := encodeULID([16]byte{15: 1}); got != "00000000000000000000000001" {
+		fmt.Println("wrong encoding of ULID:", got)
+		t.Fail()
+	}
+	if !ValidNoteID("f36112adc4cb98655790146781553eb71491e439f067ec7d109f9017132c5307") || ValidNoteID("a b") || ValidNoteID("") {
+		fmt.Println("ValidNoteID is wrong")
+		t.Fail()
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	got := NormalizeTags("  Go ops,go  mongo\n")
+	if got != "go mongo ops" {
+		t.Logf("unexpected normalized tags: %q", got)
+		t.Fail()
+	}
+	n := Note{Tags: got}
+	if !n.HasTags([]string{"go", "ops"}, true) || n.HasTags([]string{"go", "old"}, true) {
+		t.Log("HasTags with all=true is wrong")
+		t.Fail()
+	}
+	if !n.HasTags([]string{"old", "OPS"}, false) || n.HasTags([]string{"mon"}, false) {
+		t.Log("HasTags with all=false is wrong")
+		t.Fail()
+	}
+	if n.HasTags(nil, true) || n.HasTags([]string{" "}, false) {
+		t.Log("HasTags with no tags should be false")
+		t.Fail()
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(`title:deploy tag:Ops -tag:old sticky:true edited:>2026-01-01 "exact phrase" OR foo`)
+	if err != nil {
+		t.Log("failed to parse query:", err)
+		t.FailNow()
+	}
+	or, ok := q.(OrQuery)
+	if !ok || len(or) != 2 {
+		t.Logf("OR should be the root of query, got %#v", q)
+		t.FailNow()
+	}
+	if and, ok := or[0].(AndQuery); !ok || len(and) != 6 || and[1] != (TagQuery{"ops"}) || and[2] != (NotQuery{TagQuery{"old"}}) {
+		t.Logf("wrong left side of OR: %#v", or[0])
+		t.Fail()
+	}
+	n := Note{Title: "How to deploy", Body: "an exact phrase", Tags: "ops", Sticky: true,
+		LastEdited: time.Date(2026, 1, 2, 0, 0, 0, 0, time.Local)}
+	if !q.Match(n) {
+		t.Log("query should match note")
+		t.Fail()
+	}
+	n.LastEdited = time.Date(2026, 1, 1, 23, 0, 0, 0, time.Local)
+	if q.Match(n) || !q.Match(Note{Body: "Foo"}) {
+		t.Log("edited:> should exclude the whole day")
+		t.Fail()
+	}
+	reparsed, err := ParseQuery(q.String())
+	if err != nil || reparsed.String() != q.String() {
+		t.Logf("String() is not parsed back: %q %v", q.String(), err)
+		t.Fail()
+	}
+	for _, bad := range []string{"", "   ", "(foo", "foo)", "sticky:maybe", "edited:yesterday", "OR foo"} {
+		if _, err := ParseQuery(bad); !errors.Is(err, ErrBadQuery) {
+			t.Logf("query %q should not be parsed", bad)
+			t.Fail()
+		}
+	}
+	if q, err := ParseQuery("http://example.com"); err != nil || q != (TextQuery{Text: "http://example.com"}) {
+		t.Log("unknown field should be looked up as text:", q, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,604 @@
+package notepet
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrBadQuery is returned when search query can not be parsed
+var ErrBadQuery = errors.New("error: bad search query")
+
+// QueryNode is a node of parsed search query. Query language looks like
+//
+//	title:deploy tag:ops -tag:old sticky:true edited:>2026-01-01 "exact phrase" OR foo
+//
+// Terms separated by spaces must all match (AND binds tighter than OR).
+// A term is a word or "quoted phrase" matched as case insensitive substring
+// of title, body or tags, or a field filter: title:, body:, tag:, sticky:,
+// created: or edited:. Dates are compared with >, >=, <, <= or = (default)
+// and may be given as a range 2026-01-01..2026-01-31. Terms are negated
+// with leading - or NOT and grouped with parentheses.
+type QueryNode interface {
+	// Match reports whether note satisfies query
+	Match(Note) bool
+	// String returns query in the form accepted by ParseQuery
+	String() string
+}
+
+// AndQuery matches notes matching all of its nodes
+type AndQuery []QueryNode
+
+// OrQuery matches notes matching any of its nodes
+type OrQuery []QueryNode
+
+// NotQuery matches notes which do not match Node
+type NotQuery struct {
+	Node QueryNode
+}
+
+// TextQuery matches notes with Text in Field (title or body) or in any
+// of title, body and tags if Field is empty.
+type TextQuery struct {
+	Field  string
+	Text   string
+	Phrase bool
+}
+
+// TagQuery matches notes marked with Tag
+type TagQuery struct {
+	Tag string
+}
+
+// StickyQuery matches notes with Sticky flag set as requested
+type StickyQuery struct {
+	Sticky bool
+}
+
+// TimeQuery matches notes created (if Field is "created") or last
+// edited ("edited") at or after From and before Until. Zero values
+// of From and Until are not checked.
+type TimeQuery struct {
+	Field string
+	From  time.Time
+	Until time.Time
+}
+
+// ParseQuery parses search query into tree of QueryNode.
+func ParseQuery(query string) (QueryNode, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty query", ErrBadQuery)
+	}
+	p := queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %s", ErrBadQuery, p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+// MatchQuery returns notes matching query. It is used by storages
+// which keep notes in memory.
+func MatchQuery(notes []Note, query QueryNode) []Note {
+	result := []Note{}
+	for _, n := range notes {
+		if query.Match(n) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// isPlainQuery reports whether query consists only of words and phrases
+// looked up in all fields so that it can be passed to full text search.
+func isPlainQuery(query QueryNode) bool {
+	switch q := query.(type) {
+	case TextQuery:
+		return q.Field == ""
+	case AndQuery:
+		for _, node := range q {
+			if !isPlainQuery(node) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// sqlDialect describes how a backend spells conditions of QueryNode in SQL
+type sqlDialect struct {
+	placeholder func(n int) string  // placeholder of n-th argument (from 1)
+	like        string              // case insensitive pattern matching operator
+	created     string              // column holding time of note creation
+	time        func(string) string // makes expression comparable as time
+}
+
+// queryToSQL translates query into condition on columns of notes table
+// and returns it with arguments for placeholders in it. Text is matched
+// as substring with like operator of dialect.
+func queryToSQL(query QueryNode, d sqlDialect) (string, []interface{}) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return d.placeholder(len(args))
+	}
+	var translate func(QueryNode) string
+	translate = func(query QueryNode) string {
+		switch q := query.(type) {
+		case AndQuery, OrQuery:
+			var nodes []QueryNode
+			op := " and "
+			if or, ok := q.(OrQuery); ok {
+				nodes, op = or, " or "
+			} else {
+				nodes = q.(AndQuery)
+			}
+			parts := make([]string, len(nodes))
+			for i, node := range nodes {
+				parts[i] = translate(node)
+			}
+			return "(" + strings.Join(parts, op) + ")"
+		case NotQuery:
+			return "not " + translate(q.Node)
+		case TextQuery:
+			pattern := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q.Text) + "%"
+			columns := []string{"title", "body", "tags"}
+			if q.Field != "" {
+				columns = []string{q.Field}
+			}
+			parts := make([]string, len(columns))
+			for i, column := range columns {
+				parts[i] = fmt.Sprintf(`coalesce(%s, '') %s %s escape '\'`, column, d.like, arg(pattern))
+			}
+			return "(" + strings.Join(parts, " or ") + ")"
+		case TagQuery:
+			return "id in (select id from note_tags where tag = " + arg(q.Tag) + ")"
+		case StickyQuery:
+			return "sticky = " + arg(q.Sticky)
+		case TimeQuery:
+			column := "lastedited"
+			if q.Field == "created" {
+				column = d.created
+			}
+			parts := []string{}
+			if !q.From.IsZero() {
+				parts = append(parts, d.time(column)+" >= "+d.time(arg(q.From)))
+			}
+			if !q.Until.IsZero() {
+				parts = append(parts, d.time(column)+" < "+d.time(arg(q.Until)))
+			}
+			if len(parts) == 0 {
+				return "true"
+			}
+			return "(" + strings.Join(parts, " and ") + ")"
+		}
+		return "false"
+	}
+	return translate(query), args
+}
+
+func (q AndQuery) Match(n Note) bool {
+	for _, node := range q {
+		if !node.Match(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q AndQuery) String() string {
+	parts := make([]string, len(q))
+	for i, node := range q {
+		parts[i] = node.String()
+		if _, ok := node.(OrQuery); ok {
+			parts[i] = "(" + parts[i] + ")"
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (q OrQuery) Match(n Note) bool {
+	for _, node := range q {
+		if node.Match(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q OrQuery) String() string {
+	parts := make([]string, len(q))
+	for i, node := range q {
+		parts[i] = node.String()
+	}
+	return strings.Join(parts, " OR ")
+}
+
+func (q NotQuery) Match(n Note) bool {
+	return !q.Node.Match(n)
+}
+
+func (q NotQuery) String() string {
+	switch q.Node.(type) {
+	case AndQuery, OrQuery:
+		return "-(" + q.Node.String() + ")"
+	}
+	return "-" + q.Node.String()
+}
+
+func (q TextQuery) Match(n Note) bool {
+	text := strings.ToLower(q.Text)
+	switch q.Field {
+	case "title":
+		return strings.Contains(strings.ToLower(n.Title), text)
+	case "body":
+		return strings.Contains(strings.ToLower(n.Body), text)
+	}
+	return strings.Contains(strings.ToLower(n.Title), text) ||
+		strings.Contains(strings.ToLower(n.Body), text) ||
+		strings.Contains(strings.ToLower(n.Tags), text)
+}
+
+func (q TextQuery) String() string {
+	text := q.Text
+	if q.Phrase || strings.ContainsAny(text, " \t\n()\"") || isQueryKeyword(text) {
+		text = strconv.Quote(text)
+	}
+	if q.Field != "" {
+		return q.Field + ":" + text
+	}
+	return text
+}
+
+func (q TagQuery) Match(n Note) bool {
+	return n.HasTags([]string{q.Tag}, true)
+}
+
+func (q TagQuery) String() string {
+	return "tag:" + q.Tag
+}
+
+func (q StickyQuery) Match(n Note) bool {
+	return n.Sticky == q.Sticky
+}
+
+func (q StickyQuery) String() string {
+	return "sticky:" + strconv.FormatBool(q.Sticky)
+}
+
+func (q TimeQuery) Match(n Note) bool {
+	t := n.LastEdited
+	if q.Field == "created" {
+		t = n.TimeStamp
+	}
+	if !q.From.IsZero() && t.Before(q.From) {
+		return false
+	}
+	if !q.Until.IsZero() && !t.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+func (q TimeQuery) String() string {
+	switch {
+	case q.From.IsZero():
+		return q.Field + ":<" + q.Until.Format(time.RFC3339Nano)
+	case q.Until.IsZero():
+		return q.Field + ":>=" + q.From.Format(time.RFC3339Nano)
+	}
+	return q.Field + ":" + q.From.Format(time.RFC3339Nano) + ".." + q.Until.Add(-time.Nanosecond).Format(time.RFC3339Nano)
+}
+
+type queryTokenKind int
+
+const (
+	tokenTerm queryTokenKind = iota
+	tokenOr
+	tokenAnd
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	neg    bool
+	field  string
+	text   string
+	phrase bool
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenOr:
+		return "OR"
+	case tokenAnd:
+		return "AND"
+	case tokenNot:
+		return "NOT"
+	case tokenOpen:
+		return "("
+	case tokenClose:
+		return ")"
+	}
+	if t.field != "" {
+		return strconv.Quote(t.field + ":" + t.text)
+	}
+	return strconv.Quote(t.text)
+}
+
+var queryFields = map[string]bool{
+	"title": true, "body": true, "tag": true, "tags": true,
+	"sticky": true, "created": true, "edited": true, "lastedited": true,
+}
+
+func isQueryKeyword(s string) bool {
+	return s == "OR" || s == "AND" || s == "NOT"
+}
+
+// lexQuery splits query into tokens. Words are delimited by spaces and
+// parentheses, text in double quotes is kept as a single phrase.
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(query)
+	isDelim := func(r rune) bool {
+		return unicode.IsSpace(r) || r == '(' || r == ')'
+	}
+	// readQuoted returns text in quotes starting at i and position
+	// after closing quote. Unterminated phrase lasts till end of query.
+	readQuoted := func(i int) (string, int) {
+		end := i + 1
+		for end < len(runes) && runes[end] != '"' {
+			end++
+		}
+		if end == len(runes) {
+			return string(runes[i+1:]), end
+		}
+		return string(runes[i+1 : end]), end + 1
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen})
+			i++
+			continue
+		case r == ')':
+			tokens = append(tokens, queryToken{kind: tokenClose})
+			i++
+			continue
+		}
+		var tok queryToken
+		if r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) {
+			tok.neg = true
+			i++
+		}
+		if i < len(runes) && runes[i] == '(' {
+			// -( ... ) negates a group
+			tokens = append(tokens, queryToken{kind: tokenNot})
+			continue
+		}
+		if i < len(runes) && runes[i] == '"' {
+			text, end := readQuoted(i)
+			tok.text, tok.phrase, i = text, true, end
+			tokens = append(tokens, tok)
+			continue
+		}
+		start := i
+		for i < len(runes) && !isDelim(runes[i]) && runes[i] != '"' {
+			i++
+		}
+		word := string(runes[start:i])
+		if colon := strings.Index(word, ":"); colon > 0 && queryFields[strings.ToLower(word[:colon])] {
+			tok.field = strings.ToLower(word[:colon])
+			word = word[colon+1:]
+			if word == "" && i < len(runes) && runes[i] == '"' {
+				text, end := readQuoted(i)
+				word, tok.phrase, i = text, true, end
+			}
+		} else if i < len(runes) && runes[i] == '"' {
+			return nil, fmt.Errorf("%w: unexpected quote after %q", ErrBadQuery, word)
+		}
+		tok.text = word
+		if !tok.neg && tok.field == "" && isQueryKeyword(word) {
+			switch word {
+			case "OR":
+				tok.kind = tokenOr
+			case "AND":
+				tok.kind = tokenAnd
+			case "NOT":
+				tok.kind = tokenNot
+			}
+		}
+		tokens = append(tokens, tok)
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) parseOr() (QueryNode, error) {
+	var nodes OrQuery
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+		if tok, ok := p.peek(); !ok || tok.kind != tokenOr {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *queryParser) parseAnd() (QueryNode, error) {
+	var nodes AndQuery
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind == tokenOr || tok.kind == tokenClose {
+			break
+		}
+		if tok.kind == tokenAnd {
+			p.pos++
+			continue
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, fmt.Errorf("%w: expected search term", ErrBadQuery)
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *queryParser) parseUnary() (QueryNode, error) {
+	tok, _ := p.peek()
+	p.pos++
+	switch tok.kind {
+	case tokenNot:
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return NotQuery{node}, nil
+	case tokenOpen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, ok := p.peek(); !ok || tok.kind != tokenClose {
+			return nil, fmt.Errorf("%w: missing closing parenthesis", ErrBadQuery)
+		}
+		p.pos++
+		return node, nil
+	case tokenClose:
+		return nil, fmt.Errorf("%w: unexpected )", ErrBadQuery)
+	}
+	node, err := termToNode(tok)
+	if err != nil {
+		return nil, err
+	}
+	if tok.neg {
+		return NotQuery{node}, nil
+	}
+	return node, nil
+}
+
+func termToNode(tok queryToken) (QueryNode, error) {
+	if tok.text == "" && tok.field == "" {
+		return nil, fmt.Errorf("%w: empty phrase", ErrBadQuery)
+	}
+	if tok.text == "" {
+		return nil, fmt.Errorf("%w: empty value of %s:", ErrBadQuery, tok.field)
+	}
+	switch tok.field {
+	case "":
+		return TextQuery{Text: tok.text, Phrase: tok.phrase}, nil
+	case "title", "body":
+		return TextQuery{Field: tok.field, Text: tok.text, Phrase: tok.phrase}, nil
+	case "tag", "tags":
+		return TagQuery{Tag: strings.ToLower(tok.text)}, nil
+	case "sticky":
+		switch strings.ToLower(tok.text) {
+		case "true", "yes", "1":
+			return StickyQuery{true}, nil
+		case "false", "no", "0":
+			return StickyQuery{false}, nil
+		}
+		return nil, fmt.Errorf("%w: sticky must be true or false", ErrBadQuery)
+	case "lastedited":
+		tok.field = "edited"
+	}
+	return parseTimeQuery(tok.field, tok.text)
+}
+
+// parseTimeQuery parses date condition: optional comparison operator
+// followed by date (2006-01-02) or time (RFC3339), or a range of two
+// dates separated by "..". A date stands for the whole day.
+func parseTimeQuery(field, value string) (QueryNode, error) {
+	q := TimeQuery{Field: field}
+	if i := strings.Index(value, ".."); i >= 0 {
+		from, _, err := parseQueryTime(value[:i])
+		if err != nil {
+			return nil, err
+		}
+		_, until, err := parseQueryTime(value[i+2:])
+		if err != nil {
+			return nil, err
+		}
+		q.From, q.Until = from, until
+		return q, nil
+	}
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, prefix) {
+			op, value = prefix, value[len(prefix):]
+			break
+		}
+	}
+	start, end, err := parseQueryTime(value)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case ">":
+		q.From = end
+	case ">=":
+		q.From = start
+	case "<":
+		q.Until = start
+	case "<=":
+		q.Until = end
+	default:
+		q.From, q.Until = start, end
+	}
+	return q, nil
+}
+
+// parseQueryTime returns start and end of period denoted by s:
+// a day if s is a date or a single instant if s is a time.
+func parseQueryTime(s string) (time.Time, time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, t.Add(time.Nanosecond), nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%w: can not parse date %q, use YYYY-MM-DD", ErrBadQuery, s)
+}
@@ -0,0 +1,71 @@
+package notepet
+
+import (
+	"strings"
+)
+
+// Markers of matched text in SearchResult.Snippet
+const (
+	SnippetMarkStart = "<mark>"
+	SnippetMarkEnd   = "</mark>"
+)
+
+// SearchResult is a Note found by search along with its relevance
+// (higher is better) and a fragment of text with matches enclosed
+// in SnippetMarkStart and SnippetMarkEnd.
+type SearchResult struct {
+	Note
+	Rank    float64 `json:"rank,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// RankedSearcher is implemented by Storage which can order search
+// results by relevance and highlight matches.
+type RankedSearcher interface {
+	// SearchRanked looks up notes matching query and returns them
+	// most relevant first. Query may hold words, "quoted phrases"
+	// and prefixes ending with *.
+	SearchRanked(string) ([]SearchResult, error)
+}
+
+// SearchRanked looks up notes matching query in st. If st does not
+// implement RankedSearcher results of Search are returned without
+// rank and snippets.
+func SearchRanked(st Storage, query string) ([]SearchResult, error) {
+	if st == nil {
+		return []SearchResult{}, ErrStorageIsNil
+	}
+	if rs, ok := st.(RankedSearcher); ok {
+		return rs.SearchRanked(query)
+	}
+	notes, err := st.Search(query)
+	results := make([]SearchResult, len(notes))
+	for i := range notes {
+		results[i].Note = notes[i]
+	}
+	return results, err
+}
+
+// ftsQuery converts plain query (see isPlainQuery) into FTS5 query.
+// Every word or "quoted phrase" is matched as a prefix of a word so that
+// "tst" matches "tst4" as plain substring search did. Terms are implicitly
+// joined with AND. It returns empty string if query has no searchable terms.
+func ftsQuery(query QueryNode) string {
+	var terms []string
+	var collect func(QueryNode)
+	collect = func(query QueryNode) {
+		switch q := query.(type) {
+		case AndQuery:
+			for _, node := range q {
+				collect(node)
+			}
+		case TextQuery:
+			term := strings.TrimSuffix(q.Text, "*")
+			if strings.TrimSpace(term) != "" {
+				terms = append(terms, `"`+strings.ReplaceAll(term, `"`, `""`)+`"*`)
+			}
+		}
+	}
+	collect(query)
+	return strings.Join(terms, " ")
+}
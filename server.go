@@ -2,19 +2,37 @@ package notepet
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 // APIHandler implements http.Handler ready to serve requests to API
 type APIHandler struct {
 	Storage Storage
-	Tokens  map[string]struct{}
+	// Auth authenticates requests. Tokens are used if it is nil.
+	// Users other than admins see and modify only notes they own
+	// or which are shared with them.
+	Auth Authenticator
+	// Tokens holds tokens registered with RegisterToken and
+	// RegisterUser. Web interface authenticates users with them.
+	Tokens *TokenStore
+	// Events receives events of notes changed through the handler.
+	// They are served to clients at action=events endpoint.
+	Events *EventBus
+	// writeMu serializes conditional (If-Match) writes so that
+	// version check and modification of note are atomic.
+	writeMu sync.Mutex
 }
 
 // NewAPIHandler returns instance of http.Handler ready to run
@@ -24,23 +42,43 @@ func NewAPIHandler(st Storage, tokens ...string) (*APIHandler, error) {
 	}
 	var handler APIHandler
 	handler.Storage = st
-	handler.Tokens = make(map[string]struct{})
+	handler.Events = NewEventBus()
+	handler.Tokens = NewTokenStore()
 	for _, token := range tokens {
-		handler.Tokens[token] = struct{}{}
+		handler.RegisterToken(token)
 	}
 	return &handler, nil
 }
 
 // NewNotepetServer returns instance of http.Server ready to run on ListenAndServe call
 func NewNotepetServer(ip, port string, st Storage, handleweb bool, tokens ...string) (*http.Server, error) {
-	srv := &http.Server{Addr: ip + ":" + port}
 	apihandler, err := NewAPIHandler(st, tokens...)
 	if err != nil {
 		return nil, err
 	}
+	return NewNotepetServerWithHandler(ip, port, apihandler, handleweb)
+}
+
+// NewNotepetServerWithHandler is like NewNotepetServer but serves API
+// with apihandler configured by caller (e.g. with webhooks subscribed
+// to its events).
+func NewNotepetServerWithHandler(ip, port string, apihandler *APIHandler, handleweb bool) (*http.Server, error) {
+	if apihandler == nil || apihandler.Storage == nil {
+		return nil, ErrStorageIsNil
+	}
+	st := apihandler.Storage
+	srv := &http.Server{Addr: ip + ":" + port}
+	srv.RegisterOnShutdown(apihandler.Events.Close)
 	http.Handle("/api", apihandler)
+	http.Handle(apiV2Prefix+"/", apihandler)
 	if handleweb {
-		http.Handle("/notes", http.HandlerFunc(HandleWeb))
+		webhandler, err := NewWebHandler(apihandler)
+		if err != nil {
+			return nil, err
+		}
+		http.Handle("/notes", webhandler)
+		http.Handle("/notes/", webhandler)
+		setDefaultWebHandler(webhandler)
 	}
 	//Handling OS signals
 	interrupts := make(chan os.Signal, 1)
@@ -75,29 +113,61 @@ func (ah *APIHandler) RegisterStorage(st Storage) error {
 	return nil
 }
 
-// RegisterToken adds token to globalValidTokens map
-// so that server may use them for authentication
-func (ah *APIHandler) RegisterToken(token string) {
+// RegisterToken makes token authenticate admin without name
+// as all tokens did before there were users. Token is limited
+// to scopes if any are given.
+func (ah *APIHandler) RegisterToken(token string, scopes ...string) {
+	ah.RegisterUser(token, User{Role: RoleAdmin, Scopes: scopes})
+}
+
+// RegisterUser makes token authenticate user u
+func (ah *APIHandler) RegisterUser(token string, u User) {
 	if ah.Tokens == nil {
-		ah.Tokens = make(map[string]struct{})
+		ah.Tokens = NewTokenStore()
+	}
+	if err := ah.Tokens.Add(token, u); err != nil {
+		log.Printf("error registering token: %v\n", err)
 	}
-	ah.Tokens[token] = struct{}{}
 }
 
 // ServerHTTP implements http.Handler interface
 func (ah *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiV2Prefix+"/") {
+		ah.serveV2(w, r)
+		return
+	}
 	var handler http.HandlerFunc
 	switch r.URL.Query().Get("action") {
 	case "new":
-		handler = methodPut(ah.authenticate(ah.handleAPINew))
+		handler = methodPut(ah.authenticate(ScopeNotesWrite, ah.handleAPINew))
 	case "get":
-		handler = methodGet(ah.authenticate(ah.handleAPIGet))
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPIGet))
 	case "upd":
-		handler = methodPost(ah.authenticate(ah.handleAPIUpd))
+		handler = allowMethod(ah.authenticate(ScopeNotesWrite, ah.handleAPIUpd), http.MethodPost, http.MethodPatch)
 	case "del":
-		handler = methodDelete(ah.authenticate(ah.handleAPIDel))
+		handler = methodDelete(ah.authenticate(ScopeNotesDelete, ah.handleAPIDel))
 	case "search":
-		handler = methodGet(ah.authenticate(ah.handleAPISearch))
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPISearch))
+	case "history":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPIHistory))
+	case "tags":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPITags))
+	case "trash":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPITrash))
+	case "undelete":
+		handler = methodPost(ah.authenticate(ScopeNotesWrite, ah.handleAPIUndelete))
+	case "emptytrash":
+		handler = methodDelete(ah.authenticate(ScopeAdmin, ah.handleAPIEmptyTrash))
+	case "changes":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPIChanges))
+	case "events":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPIEvents))
+	case "shares":
+		handler = methodGet(ah.authenticate(ScopeNotesRead, ah.handleAPIShares))
+	case "share":
+		handler = methodPost(ah.authenticate(ScopeNotesWrite, ah.handleAPIShare))
+	case "unshare":
+		handler = methodDelete(ah.authenticate(ScopeNotesWrite, ah.handleAPIUnshare))
 	default:
 		http.Error(w, "404 not found", http.StatusNotFound)
 		return
@@ -105,21 +175,77 @@ func (ah *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler(w, r)
 }
 
-func (ah *APIHandler) authenticate(h http.HandlerFunc) http.HandlerFunc {
+// authenticate passes request to h if it bears valid token
+// granting scope needed for action
+func (ah *APIHandler) authenticate(scope string, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Notepet-Token")
-		if token == "" {
+		u, err := ah.authenticator().Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
 			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
 			return
+		} else if err != nil {
+			status := rejectCredentials(w, err)
+			msg := fmt.Sprintf("%d %s", status, http.StatusText(status))
+			if err != ErrInvalidCredentials {
+				msg += ": " + err.Error()
+			}
+			http.Error(w, msg, status)
+			return
 		}
-		if _, ok := ah.Tokens[token]; !ok {
-			http.Error(w, "403 Forbidden", http.StatusForbidden)
+		if !u.HasScope(scope) {
+			http.Error(w, "403 Forbidden: "+missingScope(scope), http.StatusForbidden)
 			return
 		}
-		h(w, r)
+		h(w, withUser(r, u))
 	}
 }
 
+// missingScope returns reason of denying request to token without scope
+func missingScope(scope string) string {
+	return "token does not grant scope " + scope
+}
+
+// authenticator returns Authenticator of requests to ah
+func (ah *APIHandler) authenticator() Authenticator {
+	if ah.Auth != nil {
+		return ah.Auth
+	}
+	if ah.Tokens == nil {
+		return Authenticators{}
+	}
+	return ah.Tokens
+}
+
+// user returns account authenticated by token
+func (ah *APIHandler) user(token string) (User, bool) {
+	if ah.Tokens == nil {
+		return User{}, false
+	}
+	return ah.Tokens.Lookup(token)
+}
+
+func (ah *APIHandler) validToken(token string) bool {
+	_, ok := ah.user(token)
+	return ok
+}
+
+// storage returns ah.Storage as seen by user who has made request
+func (ah *APIHandler) storage(r *http.Request) Storage {
+	return ForUser(ah.Storage, requestUser(r))
+}
+
+// put adds n to storage on behalf of user who has made request. Notes
+// are owned by users who add them unless admin has set other owner.
+// ID of n is kept if it is not taken (see Storage.Put), so that
+// replicas of notes keep their IDs.
+func (ah *APIHandler) put(r *http.Request, n Note) (NoteID, error) {
+	u := requestUser(r)
+	if !u.IsAdmin() || n.Owner == "" {
+		n.Owner = u.Name
+	}
+	return ah.storage(r).Put(n)
+}
+
 func methodGet(h http.HandlerFunc) http.HandlerFunc {
 	return allowMethod(h, "GET")
 }
@@ -138,14 +264,16 @@ func methodDelete(h http.HandlerFunc) http.HandlerFunc {
 
 // Handlers
 
-func allowMethod(h http.HandlerFunc, method string) http.HandlerFunc {
+func allowMethod(h http.HandlerFunc, methods ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != method {
-			w.Header().Set("Allow", method)
-			http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
-			return
+		for _, method := range methods {
+			if r.Method == method {
+				h(w, r)
+				return
+			}
 		}
-		h(w, r)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -161,33 +289,65 @@ func (ah *APIHandler) handleAPINew(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 could not parse request body", http.StatusBadRequest)
 		return
 	}
-	id, err := ah.Storage.Put(note)
-	if err != nil {
+	id, err := ah.put(r, note)
+	switch err {
+	case nil:
+	case ErrNoteExists:
+		http.Error(w, "409 note with such id already exists", http.StatusConflict)
+		return
+	case ErrBadNoteID:
+		http.Error(w, "400 invalid note id", http.StatusBadRequest)
+		return
+	default:
 		http.Error(w, "500 error putting note", http.StatusInternalServerError)
 		return
 	}
+	ah.publish(EventCreated, id)
 	w.WriteHeader(201)
 	w.Write([]byte(id.String()))
 }
 
 func (ah *APIHandler) handleAPIGet(w http.ResponseWriter, r *http.Request) {
 	reqid := r.URL.Query().Get("id")
-	// start, end
-	var notes []Note
-	var err error
-	switch reqid {
-	case "":
-		notes, err = ah.Storage.Get()
-	default:
-		notes, err = ah.Storage.Get(NoteID(reqid))
+	if reqid != "" {
+		notes, err := ah.storage(r).Get(NoteID(reqid))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if len(notes) > 0 {
+			w.Header().Set("ETag", notes[0].ETag())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(noteListToBytes(notes))
+		return
 	}
+	opts, err := parseListOptions(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	w.Write(noteListToBytes(notes))
+	each := streamAll(ah.storage(r))
+	emptyErr := ErrNoNotesFound
+	if !isFullList(opts) {
+		page, err := List(ah.storage(r), opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		setPageHeaders(w, page)
+		if page.Total > 0 {
+			emptyErr = nil // requested page is past the end
+		}
+		each = streamList(page.Notes)
+	}
+	if err := writeJSONStream(w, r, emptyErr, each); err != nil {
+		if err == ErrNoNotesFound {
+			w.Header().Set("Notepet-Total-Count", "0")
+		}
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
 }
 
 func (ah *APIHandler) handleAPIUpd(w http.ResponseWriter, r *http.Request) {
@@ -202,16 +362,42 @@ func (ah *APIHandler) handleAPIUpd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
-	note, err := bytesToNote(data)
-	if err != nil {
-		http.Error(w, "400 could not parse request body", http.StatusBadRequest)
+	ah.writeMu.Lock()
+	defer ah.writeMu.Unlock()
+	if !ah.checkIfMatch(w, r, NoteID(reqid)) {
 		return
 	}
-	newID, err := ah.Storage.Upd(NoteID(reqid), note)
-	if err != nil {
+	wasSticky := ah.isSticky(NoteID(reqid))
+	var newID NoteID
+	if r.Method == http.MethodPatch {
+		var patch NotePatch
+		if err := json.Unmarshal(data, &patch); err != nil {
+			http.Error(w, "400 could not parse request body", http.StatusBadRequest)
+			return
+		}
+		newID, err = PatchNote(ah.storage(r), NoteID(reqid), patch)
+	} else {
+		var note Note
+		if note, err = bytesToNote(data); err != nil {
+			http.Error(w, "400 could not parse request body", http.StatusBadRequest)
+			return
+		}
+		newID, err = ah.storage(r).Upd(NoteID(reqid), note)
+	}
+	if err == ErrNoNotesFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrPermissionDenied {
+		http.Error(w, "403 "+err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if updated, err := ah.storage(r).Get(newID); err == nil && len(updated) > 0 {
+		w.Header().Set("ETag", updated[0].ETag())
+	}
+	ah.publishUpdate(newID, wasSticky)
 	w.WriteHeader(202)
 	w.Write([]byte(newID.String()))
 }
@@ -222,10 +408,19 @@ func (ah *APIHandler) handleAPIDel(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 no id requested", http.StatusBadRequest)
 		return
 	}
-	if err := ah.Storage.Del(NoteID(reqid)); err != nil {
+	ah.writeMu.Lock()
+	defer ah.writeMu.Unlock()
+	if !ah.checkIfMatch(w, r, NoteID(reqid)) {
+		return
+	}
+	if err := ah.storage(r).Del(NoteID(reqid)); err == ErrPermissionDenied {
+		http.Error(w, "403 "+err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	ah.publish(EventDeleted, NoteID(reqid))
 	w.WriteHeader(200)
 	w.Write([]byte("200 note deleted " + reqid))
 }
@@ -236,14 +431,319 @@ func (ah *APIHandler) handleAPISearch(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "400 no search query provided", http.StatusBadRequest)
 		return
 	}
-	notelist, err := ah.Storage.Search(searchquery)
+	if _, err := ParseQuery(searchquery); err != nil {
+		http.Error(w, "400 "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := SearchRanked(ah.storage(r), searchquery)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	// results are notes with rank and snippet fields added
+	// so older clients still can read them as notes
+	writeJSONStream(w, r, nil, func(write func(interface{}) error) error {
+		for _, result := range results {
+			if err := write(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ah *APIHandler) handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	reqid := r.URL.Query().Get("id")
+	if reqid == "" {
+		http.Error(w, "400 no id requested", http.StatusBadRequest)
+		return
+	}
+	hs, ok := ah.storage(r).(HistoryStorage)
+	if !ok {
+		http.Error(w, "501 storage does not keep history", http.StatusNotImplemented)
+		return
+	}
+	var data []byte
+	if reqrev := r.URL.Query().Get("rev"); reqrev != "" {
+		rev, err := strconv.Atoi(reqrev)
+		if err != nil {
+			http.Error(w, "400 invalid revision", http.StatusBadRequest)
+			return
+		}
+		revision, err := hs.Revision(NoteID(reqid), rev)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		data, _ = json.MarshalIndent(revision, "", "    ")
+	} else {
+		revisions, err := hs.History(NoteID(reqid))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		data, _ = json.MarshalIndent(revisions, "", "    ")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (ah *APIHandler) handleAPITags(w http.ResponseWriter, r *http.Request) {
+	counts, err := listTags(ah.storage(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.MarshalIndent(counts, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (ah *APIHandler) handleAPIChanges(w http.ResponseWriter, r *http.Request) {
+	feed, status, err := ah.changeFeed(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	data, _ := json.MarshalIndent(feed, "", "    ")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	w.Write(noteListToBytes(notelist))
+	w.Write(data)
+}
+
+func (ah *APIHandler) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	serveEvents(w, r, ah.Events, ah.eventFilter(r))
+}
+
+func (ah *APIHandler) handleAPITrash(w http.ResponseWriter, r *http.Request) {
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		http.Error(w, "501 storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	notes, err := ts.Trash()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, _ := json.MarshalIndent(notes, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (ah *APIHandler) handleAPIUndelete(w http.ResponseWriter, r *http.Request) {
+	reqid := r.URL.Query().Get("id")
+	if reqid == "" {
+		http.Error(w, "400 no id requested", http.StatusBadRequest)
+		return
+	}
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		http.Error(w, "501 storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	if err := ts.Undelete(NoteID(reqid)); err == ErrNoteExists {
+		http.Error(w, "409 "+err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ah.publish(EventCreated, NoteID(reqid))
+	w.WriteHeader(200)
+	w.Write([]byte(reqid))
+}
+
+func (ah *APIHandler) handleAPIEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	before, err := parseTrashBefore(r)
+	if err != nil {
+		http.Error(w, "400 invalid before parameter", http.StatusBadRequest)
+		return
+	}
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		http.Error(w, "501 storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	n, err := ts.EmptyTrash(before)
+	if err == ErrPermissionDenied {
+		http.Error(w, "403 "+err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(strconv.Itoa(n)))
+}
+
+func (ah *APIHandler) handleAPIShares(w http.ResponseWriter, r *http.Request) {
+	shares, err := ah.shares(r, NoteID(r.URL.Query().Get("id")))
+	if err != nil {
+		http.Error(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	data, _ := json.MarshalIndent(shares, "", "    ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(data)
+}
+
+func (ah *APIHandler) handleAPIShare(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	share := Share{ID: NoteID(q.Get("id")), Grantee: q.Get("grantee"), Access: q.Get("access")}
+	if share.Access == "" {
+		share.Access = AccessRead
+	}
+	if err := ah.share(r, share); err != nil {
+		http.Error(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(share.ID.String()))
+}
+
+func (ah *APIHandler) handleAPIUnshare(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := ah.unshare(r, NoteID(q.Get("id")), q.Get("grantee")); err != nil {
+		http.Error(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte(q.Get("id")))
+}
+
+// parseTagQuery returns tags requested with "tag" parameters of request
+// (each may hold several tags separated by commas) and whether notes
+// should have all of them ("match=all", default) or any ("match=any").
+func parseTagQuery(r *http.Request) (tags []string, all bool) {
+	q := r.URL.Query()
+	tags = ParseTags(strings.Join(q["tag"], ","))
+	return tags, q.Get("match") != "any"
+}
+
+// parseListOptions reads sort, limit, offset, cursor and tag
+// parameters of request.
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	q := r.URL.Query()
+	opts := ListOptions{Sort: q.Get("sort"), Cursor: q.Get("cursor")}
+	opts.Tags, opts.AllTags = parseTagQuery(r)
+	for name, value := range map[string]*int{"limit": &opts.Limit, "offset": &opts.Offset} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, ErrBadListOptions
+			}
+			*value = n
+		}
+	}
+	return opts, opts.normalize()
+}
+
+// changeFeed returns changes requested with since and limit parameters
+// of request or HTTP status and error if they can not be returned.
+func (ah *APIHandler) changeFeed(r *http.Request) (ChangeFeed, int, error) {
+	q := r.URL.Query()
+	seq, t, err := parseSince(q.Get("since"))
+	if err != nil {
+		return ChangeFeed{}, http.StatusBadRequest, err
+	}
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return ChangeFeed{}, http.StatusBadRequest, fmt.Errorf("error: invalid limit %q", v)
+		}
+	}
+	var feed ChangeFeed
+	if t.IsZero() {
+		feed, err = Changes(ah.storage(r), seq, limit)
+	} else {
+		feed, err = ChangesSince(ah.storage(r), t, limit)
+	}
+	if err != nil {
+		return feed, http.StatusInternalServerError, err
+	}
+	return feed, http.StatusOK, nil
+}
+
+// setPageHeaders tells client total number of notes matching request
+// and cursor of the next page if there is one.
+func setPageHeaders(w http.ResponseWriter, page Page) {
+	w.Header().Set("Notepet-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != "" {
+		w.Header().Set("Notepet-Next-Cursor", page.Next)
+	}
+}
+
+// listTags returns tags used in st with number of notes marked with each
+func listTags(st Storage) ([]TagCount, error) {
+	if ts, ok := st.(TagStorage); ok {
+		return ts.Tags()
+	}
+	notes, err := st.Get()
+	if err != nil && err != ErrNoNotesFound {
+		return []TagCount{}, err
+	}
+	return CountTags(notes), nil
+}
+
+// parseTrashBefore returns time passed in "before" parameter of request
+// (RFC3339, fractional seconds allowed) or current time if parameter is missing.
+func parseTrashBefore(r *http.Request) (time.Time, error) {
+	before := r.URL.Query().Get("before")
+	if before == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339Nano, before)
+}
+
+// checkIfMatch compares If-Match header of request (if present) to
+// ETag of current version of note with id. If they do not match it
+// writes 412 Precondition Failed to w and returns false.
+// Caller should hold ah.writeMu.
+func (ah *APIHandler) checkIfMatch(w http.ResponseWriter, r *http.Request, id NoteID) bool {
+	switch err := ah.ifMatch(r, id).(type) {
+	case nil:
+		return true
+	case *ConflictError:
+		w.Header().Set("ETag", err.ETag)
+		http.Error(w, "412 Precondition Failed: note has been modified", http.StatusPreconditionFailed)
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	}
+	return false
+}
+
+// ifMatch returns *ConflictError if If-Match header of r does not match
+// current version of note with id.
+func (ah *APIHandler) ifMatch(r *http.Request, id NoteID) error {
+	return ah.matchETag(r, id, r.Header.Get("If-Match"))
+}
+
+// matchETag returns *ConflictError if want (list of ETags as in If-Match
+// header) does not match current version of note with id as seen by
+// user who has made request. Empty want matches any version.
+func (ah *APIHandler) matchETag(r *http.Request, id NoteID, want string) error {
+	if want == "" {
+		return nil
+	}
+	notes, err := ah.storage(r).Get(id)
+	if err != nil || len(notes) == 0 {
+		return ErrNoNotesFound
+	}
+	current := notes[0].ETag()
+	if want == "*" {
+		return nil
+	}
+	for _, etag := range strings.Split(want, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(etag), "W/") == current {
+			return nil
+		}
+	}
+	return &ConflictError{ID: id, ETag: current}
 }
 
 // HandleFavicon is intended to be used to handle request to /favicon.ico
@@ -1,11 +1,25 @@
 package notepet
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 type fakeStorage struct {
@@ -51,8 +65,8 @@ func initFakeStorage() (*fakeStorage, error) {
 }
 
 func initTestHandler(s Storage) http.Handler {
-	tokens := make(map[string]struct{})
-	tokens["test"] = struct{}{}
+	tokens := NewTokenStore()
+	tokens.Add("test", User{Role: RoleAdmin})
 	hndlr := APIHandler{Storage: s, Tokens: tokens}
 	return &hndlr
 }
@@ -85,3 +99,818 @@ func Test_APIHandlerSearch(t *testing.T) {
 		}
 	}
 }
+
+func Test_WebHandlerList(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh, err := NewWebHandler(initTestHandler(s).(*APIHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/notes", nil)
+	w := httptest.NewRecorder()
+	wh.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/notes/login" {
+		t.Logf("unauthenticated request not redirected to login: %v", w.Code)
+		t.Fail()
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/notes", nil)
+	req.AddCookie(&http.Cookie{Name: webTokenCookie, Value: "test"})
+	w = httptest.NewRecorder()
+	wh.ServeHTTP(w, req)
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Logf("got status %v", w.Code)
+		t.Fail()
+	}
+	for _, n := range s.Notes {
+		if !strings.Contains(body, n.Title) || !strings.Contains(body, "/notes/"+n.ID.String()) {
+			t.Logf("list page is missing note %v", n.ID)
+			t.Fail()
+		}
+	}
+}
+
+func Test_WebHandlerConflict(t *testing.T) {
+	testDBfile := "./test_web_conflict.db"
+	os.Remove(testDBfile)
+	s, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testDBfile)
+	defer s.Close()
+	wh, err := NewWebHandler(initTestHandler(s).(*APIHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Put(Note{Title: "original", Body: "body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes, _ := s.Get(id)
+	stale := notes[0].ETag()
+	if id, err = s.Upd(id, Note{Title: "changed meanwhile", Body: "by someone else"}); err != nil {
+		t.Fatal(err)
+	}
+	post := func(action string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/notes/"+action+"/"+id.String(), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: webTokenCookie, Value: "test"})
+		w := httptest.NewRecorder()
+		wh.ServeHTTP(w, req)
+		return w
+	}
+	w := post("edit", url.Values{"etag": {stale}, "title": {"my edit"}, "body": {"stale body"}})
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "changed meanwhile") || !strings.Contains(w.Body.String(), "my edit") {
+		t.Logf("edit of stale version: expected 409 with both versions, got %v", w.Code)
+		t.Fail()
+	}
+	if notes, _ := s.Get(id); len(notes) != 1 || notes[0].Title != "changed meanwhile" {
+		t.Logf("stale edit has overwritten note: %v", notes)
+		t.Fail()
+	}
+	if w := post("del", url.Values{"etag": {stale}}); w.Code != http.StatusConflict {
+		t.Logf("delete of stale version: expected 409, got %v", w.Code)
+		t.Fail()
+	}
+	if notes, _ := s.Get(id); len(notes) != 1 {
+		t.Logf("stale delete has removed note")
+		t.Fail()
+	}
+	notes, _ = s.Get(id)
+	if w := post("edit", url.Values{"etag": {notes[0].ETag()}, "title": {"my edit"}}); w.Code != http.StatusSeeOther {
+		t.Logf("edit of current version: expected 303, got %v", w.Code)
+		t.Fail()
+	}
+}
+
+func Test_APIv2Create(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hndlr := initTestHandler(s)
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/api/v2/notes", strings.NewReader(`{"title": "new", "body": "note"}`))
+	req.Header.Add("Notepet-Token", "test")
+	w := httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/api/v2/notes/abcdef" {
+		t.Logf("got status %v, location %q", w.Code, w.Header().Get("Location"))
+		t.Fail()
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "http://example.com/api/v2/notes", nil)
+	req.Header.Add("Notepet-Token", "test")
+	w = httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	var apierr apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &apierr); err != nil || apierr.Error.Status != http.StatusMethodNotAllowed {
+		t.Logf("expected error envelope with 405, got %v: %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_APIv2MissingNote(t *testing.T) {
+	testDBfile := "./test_v2_missing.db"
+	os.Remove(testDBfile)
+	st, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(testDBfile)
+	defer st.Close()
+	hndlr := initTestHandler(st)
+	for _, method := range []string{http.MethodDelete, http.MethodPut, http.MethodPatch} {
+		req := httptest.NewRequest(method, "http://example.com/api/v2/notes/nosuchnote", strings.NewReader(`{"title": "title"}`))
+		req.Header.Add("Notepet-Token", "test")
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Log(method, "of missing note is not reported as not found:", w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func Test_APIHandlerIfMatch(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hndlr := initTestHandler(s)
+	etag := s.Notes[0].ETag()
+	for _, tc := range []struct {
+		ifmatch string
+		status  int
+	}{
+		{`"0000000000000000"`, http.StatusPreconditionFailed},
+		{etag, http.StatusAccepted},
+		{"", http.StatusAccepted},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/api?action=upd&id="+s.Notes[0].ID.String(), strings.NewReader(`{"body": "new body"}`))
+		req.Header.Add("Notepet-Token", "test")
+		if tc.ifmatch != "" {
+			req.Header.Add("If-Match", tc.ifmatch)
+		}
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Logf("If-Match %q: expected status %v, got %v", tc.ifmatch, tc.status, w.Code)
+			t.Fail()
+		}
+		if w.Code == http.StatusPreconditionFailed && w.Header().Get("ETag") != etag {
+			t.Logf("412 response should hold current ETag")
+			t.Fail()
+		}
+	}
+}
+
+func Test_APIHandlerListPage(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	hndlr := initTestHandler(s)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api?action=get&sort=title&limit=3", nil)
+	req.Header.Add("Notepet-Token", "test")
+	w := httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	resp := w.Result()
+	notes, _ := bytesToNoteList(w.Body.Bytes())
+	if resp.StatusCode != http.StatusOK || len(notes) != 3 || notes[0].Title != "Test1" {
+		t.Log("wrong page of notes:", resp.Status, notes)
+		t.Fail()
+	}
+	if resp.Header.Get("Notepet-Total-Count") != "4" || resp.Header.Get("Notepet-Next-Cursor") == "" {
+		t.Log("missing page headers:", resp.Header)
+		t.Fail()
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/api?action=get&sort=random", nil)
+	req.Header.Add("Notepet-Token", "test")
+	w = httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Log("unknown sort order should be rejected, got", w.Code)
+		t.Fail()
+	}
+}
+
+func Test_APIHandlerNDJSON(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	hndlr := initTestHandler(s)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api?action=get", nil)
+	req.Header.Add("Notepet-Token", "test")
+	req.Header.Add("Accept", NDJSONContentType)
+	w := httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != NDJSONContentType {
+		t.Log("wrong content type of NDJSON response:", ct)
+		t.Fail()
+	}
+	var notes []Note
+	err = DecodeNotes(w.Body, func(n Note) error {
+		notes = append(notes, n)
+		return nil
+	})
+	if err != nil || len(notes) != len(s.Notes) || notes[0] != s.Notes[0] {
+		t.Log("wrong notes in NDJSON response:", notes, err)
+		t.Fail()
+	}
+}
+
+func Test_APIHandlerChanges(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	hndlr := initTestHandler(s)
+	for _, target := range []string{"/api?action=changes&since=0&limit=2", "/api/v2/changes?limit=2"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		req.Header.Add("Notepet-Token", "test")
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		var feed ChangeFeed
+		if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || len(feed.Changes) != 2 || !feed.More || feed.Changes[1].Seq != feed.Last {
+			t.Log("wrong feed of changes:", target, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api?action=changes&since=yesterday", nil)
+	req.Header.Add("Notepet-Token", "test")
+	w := httptest.NewRecorder()
+	hndlr.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Log("invalid since should be rejected:", w.Code)
+		t.Fail()
+	}
+}
+
+func Test_APIHandlerEvents(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hndlr, _ := NewAPIHandler(s, "test")
+	srv := httptest.NewServer(hndlr)
+	defer srv.Close()
+	defer hndlr.Events.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api?action=events", nil)
+	req.Header.Add("Notepet-Token", "test")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.Header.Get("Content-Type") != EventStreamContentType {
+		t.Fatal("could not subscribe to events:", err)
+	}
+	defer resp.Body.Close()
+	req, _ = http.NewRequest(http.MethodPut, srv.URL+"/api?action=new", strings.NewReader(`{"title": "new", "body": "note"}`))
+	req.Header.Add("Notepet-Token", "test")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatal("could not create note:", err)
+	}
+	var got Event
+	readEvents(resp.Body, func(e Event) error {
+		got = e
+		return io.EOF // stop reading
+	})
+	if got.Type != EventCreated || got.ID != "abcdef" {
+		t.Log("wrong event received:", got)
+		t.Fail()
+	}
+}
+
+func Test_HandleWeb(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh, err := NewWebHandler(initTestHandler(s).(*APIHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setDefaultWebHandler(nil)
+	setDefaultWebHandler(nil)
+	w := httptest.NewRecorder()
+	HandleWeb(w, httptest.NewRequest(http.MethodGet, "http://example.com/notes", nil))
+	if w.Code != http.StatusNotFound {
+		t.Log("web interface without server is not reported as not found:", w.Code)
+		t.Fail()
+	}
+	done := make(chan struct{})
+	go func() {
+		setDefaultWebHandler(wh)
+		close(done)
+	}()
+	HandleWeb(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/notes", nil))
+	<-done
+	w = httptest.NewRecorder()
+	HandleWeb(w, httptest.NewRequest(http.MethodGet, "http://example.com/notes", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Log("web interface of server is not served:", w.Code)
+		t.Fail()
+	}
+}
+
+func Test_WebhookDispatcher(t *testing.T) {
+	attempts := make(chan *http.Request, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !VerifyWebhook("secret", body, r.Header.Get(WebhookSignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+		} else if len(attempts) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		attempts <- r
+	}))
+	defer hook.Close()
+	d := NewWebhookDispatcher([]Webhook{{URL: hook.URL, Secret: "secret", Events: []string{EventCreated}}}, nil)
+	d.Backoff = time.Millisecond
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(256)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		d.Run(events)
+		close(done)
+	}()
+	bus.Publish(Event{Type: EventDeleted, ID: "abc"})
+	bus.Publish(Event{Type: EventCreated, ID: "abcdef"})
+	bus.Close()
+	<-done
+	deliveries := d.Deliveries()
+	if len(deliveries) != 2 || deliveries[0].Status != http.StatusServiceUnavailable || !deliveries[1].Delivered || deliveries[1].Attempt != 2 {
+		t.Log("wrong deliveries:", deliveries)
+		t.Fail()
+	}
+	if r := <-attempts; r.Header.Get(WebhookEventHeader) != EventCreated {
+		t.Log("wrong event header:", r.Header)
+		t.Fail()
+	}
+}
+
+func Test_APIClientConflicts(t *testing.T) {
+	st, err := OpenOrInitJSONFileStorage("./test_client.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_client.json")
+	defer os.Remove("./test_client.json.meta")
+	hndlr, _ := NewAPIHandler(st, "test")
+	srv := httptest.NewServer(hndlr)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/api")
+	ac := &APIClient{Token: "test", HTTPClient: srv.Client(), URL: *u}
+	id, err := ac.Put(Note{ID: "client-note", Title: "Title", Body: "Body"})
+	if err != nil {
+		t.Fatal("could not put note:", err)
+	}
+	if _, err := ac.Put(Note{ID: id, Title: "Other"}); err != ErrNoteExists {
+		t.Log("putting note with existing ID should return ErrNoteExists:", err)
+		t.Fail()
+	}
+	if _, err := ac.UpdIfMatch(id, Note{Title: "Stale"}, `"stale"`); err == nil {
+		t.Log("update with stale ETag succeeded")
+		t.Fail()
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Log("update with stale ETag should return ConflictError:", err)
+		t.Fail()
+	}
+	if err := ac.Del(id); err != nil {
+		t.Fatal("could not delete note:", err)
+	}
+	if n, err := ac.EmptyTrash(time.Now()); err != nil || n != 1 {
+		t.Log("emptying trash right after deletion should remove note:", n, err)
+		t.Fail()
+	}
+}
+
+func Test_ReplicaSyncUser(t *testing.T) {
+	st, err := OpenOrInitJSONFileStorage("./test_replica_user.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localFile := "./test_replica_user.db"
+	for _, f := range []string{"./test_replica_user.json", "./test_replica_user.json.meta", localFile, localFile + ".sync"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	hndlr, _ := NewAPIHandler(st)
+	hndlr.RegisterUser("alice-token", User{Name: "alice", Role: RoleUser})
+	srv := httptest.NewServer(hndlr)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL + "/api")
+	replica, err := OpenSQLiteReplica(localFile, &APIClient{Token: "alice-token", HTTPClient: srv.Client(), URL: *u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	for _, title := range []string{"first", "second"} {
+		if _, err := replica.Put(Note{Title: title, Body: "added offline"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err := replica.Sync(); err != nil || len(report.Pushed) != 2 {
+		t.Log("notes added offline are not pushed:", err, report)
+		t.Fail()
+	}
+	if report, err := replica.Sync(); err != nil || len(report.Pulled)+len(report.Pushed)+len(report.Conflicts) != 0 {
+		t.Log("second sync should do nothing:", err, report)
+		t.Fail()
+	}
+	local, _ := replica.Get()
+	remote, _ := st.Get()
+	if len(local) != 2 || len(remote) != 2 {
+		t.Log("notes are duplicated by sync:", len(local), len(remote))
+		t.Fail()
+	}
+	for _, n := range local {
+		if found, _ := st.Get(n.ID); len(found) != 1 || found[0].Owner != "alice" {
+			t.Log("note is not kept by server under its ID:", n.ID, found)
+			t.Fail()
+		}
+	}
+}
+
+func Test_APIHandlerUsers(t *testing.T) {
+	st, err := OpenOrInitJSONFileStorage("./test_users.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_users.json")
+	defer os.Remove("./test_users.json.meta")
+	hndlr, _ := NewAPIHandler(st)
+	hndlr.RegisterUser("alice-token", User{Name: "alice", Role: RoleUser})
+	hndlr.RegisterUser("bob-token", User{Name: "bob", Role: RoleUser})
+	hndlr.RegisterUser("root-token", User{Name: "root", Role: RoleAdmin})
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+target, strings.NewReader(body))
+		req.Header.Add("Notepet-Token", token)
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		return w
+	}
+	w := do(http.MethodPost, "/api/v2/notes", "alice-token", `{"title": "alice's", "owner": "bob"}`)
+	var note Note
+	if err := json.Unmarshal(w.Body.Bytes(), &note); err != nil || note.Owner != "alice" {
+		t.Fatal("note is not owned by user who created it:", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/api/v2/notes/"+note.ID.String(), "bob-token", ""); w.Code != http.StatusNotFound {
+		t.Log("other user can get note:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPut, "/api/v2/notes/"+note.ID.String(), "bob-token", `{"title": "bob's"}`); w.Code != http.StatusNotFound {
+		t.Log("update of note of other user is not reported as not found:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPost, "/api?action=upd&id="+note.ID.String(), "bob-token", `{"title": "bob's"}`); w.Code != http.StatusNotFound {
+		t.Log("update of note of other user is not reported as not found:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api?action=del&id="+note.ID.String(), "bob-token", ""); w.Code == http.StatusOK {
+		t.Log("other user can delete note:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api?action=get", "bob-token", ""); w.Code != http.StatusNotFound {
+		t.Log("other user lists note:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api/v2/notes/"+note.ID.String(), "root-token", ""); w.Code != http.StatusOK {
+		t.Log("admin can not get note:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPost, "/api?action=share&id="+note.ID.String()+"&grantee=alice", "bob-token", ""); w.Code != http.StatusNotFound {
+		t.Log("other user can share note:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPut, "/api/v2/notes/"+note.ID.String()+"/shares/bob", "alice-token", `{"access": "r"}`); w.Code != http.StatusOK {
+		t.Log("owner can not share note:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api/v2/notes/"+note.ID.String(), "bob-token", ""); w.Code != http.StatusOK {
+		t.Log("user can not get note shared with them:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPatch, "/api/v2/notes/"+note.ID.String(), "bob-token", `{"title": "bob's"}`); w.Code != http.StatusForbidden {
+		t.Log("user can update note shared read only:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api?action=shares", "bob-token", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), note.ID.String()) {
+		t.Log("shares granted to user are not listed:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodPut, "/api/v2/notes/"+note.ID.String()+"/shares/bob", "alice-token", `{"access": "rwx"}`); w.Code != http.StatusBadRequest {
+		t.Log("share with unknown access is accepted:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api/v2/notes/"+note.ID.String()+"/shares/bob", "alice-token", ""); w.Code != http.StatusNoContent {
+		t.Log("owner can not unshare note:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api/v2/notes/"+note.ID.String(), "bob-token", ""); w.Code != http.StatusNotFound {
+		t.Log("user can get note after it has been unshared:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api/v2/trash", "alice-token", ""); w.Code != http.StatusForbidden {
+		t.Log("user can empty trash:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodPost, "/api/v2/notes", "alice-token", `{"id": "chosen-by-alice", "title": "alice's"}`); w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "chosen-by-alice") {
+		t.Log("user can not choose ID of new note:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodPost, "/api/v2/notes", "bob-token", `{"id": "chosen-by-alice", "title": "bob's"}`); w.Code != http.StatusConflict {
+		t.Log("user can take ID of note of other user:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodPut, "/api?action=new", "root-token", `{"id": "chosen-by-root", "title": "root's"}`); w.Code != http.StatusCreated || w.Body.String() != "chosen-by-root" {
+		t.Log("admin can not choose ID of new note:", w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+func Test_APIHandlerScopes(t *testing.T) {
+	s, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hndlr, _ := NewAPIHandler(s)
+	hndlr.RegisterToken("dashboard", ScopeNotesRead)
+	hndlr.RegisterToken("writer", ScopeNotesRead, ScopeNotesWrite)
+	hndlr.RegisterToken("admin", ScopeAdmin)
+	do := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+target, nil)
+		req.Header.Add("Notepet-Token", token)
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		return w
+	}
+	if w := do(http.MethodGet, "/api?action=search&q=test", "dashboard"); w.Code != http.StatusOK {
+		t.Log("read only token can not search:", w.Code)
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api?action=del&id=1", "dashboard"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeNotesDelete) {
+		t.Log("read only token can delete notes or reason is missing:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api/v2/notes/1", "writer"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeNotesDelete) {
+		t.Log("token without delete scope can delete notes:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodDelete, "/api/v2/trash", "writer"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeAdmin) {
+		t.Log("token without admin scope can empty trash:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := do(http.MethodGet, "/api/v2/notes?q=test", "admin"); w.Code != http.StatusOK {
+		t.Log("admin scope does not grant reading notes:", w.Code)
+		t.Fail()
+	}
+}
+
+func Test_ParseUserToken(t *testing.T) {
+	if u, token, err := ParseUserToken("alice:secret:admin"); err != nil || u.Name != "alice" || !u.IsAdmin() || token != "secret" {
+		t.Log("wrong user parsed:", u, token, err)
+		t.Fail()
+	}
+	if u, _, err := ParseUserToken("bob:secret"); err != nil || u.Role != RoleUser {
+		t.Log("user should have default role:", u, err)
+		t.Fail()
+	}
+	if u, _, err := ParseUserToken("carol:secret::ops,dev"); err != nil || u.Role != RoleUser || len(u.Groups) != 2 || u.Groups[1] != "dev" {
+		t.Log("groups of user are not parsed:", u, err)
+		t.Fail()
+	}
+	if u, _, err := ParseUserToken("dash:secret:user::notes:read"); err != nil || len(u.Scopes) != 1 || !u.HasScope(ScopeNotesRead) || u.HasScope(ScopeNotesWrite) {
+		t.Log("scopes of token are not parsed:", u, err)
+		t.Fail()
+	}
+	for _, line := range []string{"secret", ":secret", "bob:secret:root", "bob:secret:user::notes:all", "@ops:secret"} {
+		if _, _, err := ParseUserToken(line); err == nil {
+			t.Log("invalid line accepted:", line)
+			t.Fail()
+		}
+	}
+}
+
+func Test_TokenStore(t *testing.T) {
+	os.WriteFile("./test_tokens.conf", []byte("# tokens\nadmin-token\nalice:alice-token:user:ops\n"), 0600)
+	defer os.Remove("./test_tokens.conf")
+	tokens, err := OpenTokenStore("./test_tokens.conf")
+	if err != nil || !tokens.Legacy() {
+		t.Fatal("plain tokens are not read:", err)
+	}
+	if u, ok := tokens.Lookup("alice-token"); !ok || u.Name != "alice" || u.Groups[0] != "ops" {
+		t.Log("plain token of user does not authenticate:", u, ok)
+		t.Fail()
+	}
+	if u, ok := tokens.Lookup("admin-token"); !ok || !u.IsAdmin() {
+		t.Log("plain admin token does not authenticate:", u, ok)
+		t.Fail()
+	}
+	token, created, err := tokens.Create("dashboard", User{Name: "bob", Role: RoleUser}, time.Time{})
+	if err != nil {
+		t.Fatal("failed to create token:", err)
+	}
+	data, _ := os.ReadFile("./test_tokens.conf")
+	if tokens.Legacy() || strings.Contains(string(data), token) || strings.Contains(string(data), "alice-token") {
+		t.Log("tokens are saved in plain text:", string(data))
+		t.Fail()
+	}
+	if u, ok := tokens.Lookup(token); !ok || u.Name != "bob" {
+		t.Log("created token does not authenticate:", u, ok)
+		t.Fail()
+	}
+	if _, ok := tokens.Lookup(token + "x"); ok {
+		t.Log("wrong token authenticates")
+		t.Fail()
+	}
+	if err := tokens.Save(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenTokenStore("./test_tokens.conf")
+	if err != nil || len(reopened.List()) != 3 {
+		t.Fatal("saved tokens are not read back:", err)
+	}
+	for _, tk := range reopened.List() {
+		if tk.ID == created.ID && (tk.Label != "dashboard" || tk.LastUsed.IsZero()) {
+			t.Log("label or last used time of token is not saved:", tk)
+			t.Fail()
+		}
+	}
+	if err := reopened.Expire(created.ID, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokens.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tokens.Lookup(token); ok {
+		t.Log("expired token authenticates after reload")
+		t.Fail()
+	}
+	if err := reopened.Revoke(created.ID); err != nil || reopened.Revoke(created.ID) != ErrNoSuchToken {
+		t.Log("failed to revoke token:", err)
+		t.Fail()
+	}
+	if err := tokens.Save(); err != nil || len(tokens.List()) != 2 {
+		t.Log("saving tokens brings back revoked one:", err, tokens.List())
+		t.Fail()
+	}
+}
+
+// signJWT returns JWT with claims signed with RS256, ES256 or HS256
+// depending on type of key
+func signJWT(t *testing.T, kid string, key interface{}, claims map[string]interface{}) string {
+	alg := "RS256"
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	case []byte:
+		alg = "HS256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, e := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err = e; err == nil {
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+		}
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func Test_JWTAuthenticator(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&eckey.PublicKey)
+	os.WriteFile("./test_jwt.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{"kid": "ec"}, Bytes: der}), 0600)
+	defer os.Remove("./test_jwt.pem")
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "rsa",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(rsakey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+	}}})
+	os.WriteFile("./test_jwks.json", jwks, 0600)
+	defer os.Remove("./test_jwks.json")
+	keys := []JWTKey{}
+	for _, file := range []string{"./test_jwt.pem", "./test_jwks.json"} {
+		read, err := ReadJWTKeys(file)
+		if err != nil || len(read) != 1 {
+			t.Fatal("failed to read keys:", file, err)
+		}
+		keys = append(keys, read...)
+	}
+
+	st, err := initFakeStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hndlr, _ := NewAPIHandler(st, "static-token")
+	hndlr.Auth = Authenticators{hndlr.Tokens, NewJWTAuthenticator(keys, "https://idp.example.com", "notepet")}
+	claims := func(edit func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"notepet", "other"},
+			"sub":    "alice",
+			"role":   "admin",
+			"groups": []string{"ops"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	do := func(method, target, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com"+target, nil)
+		req.Header.Add(header, value)
+		w := httptest.NewRecorder()
+		hndlr.ServeHTTP(w, req)
+		return w
+	}
+	for _, key := range []interface{}{rsakey, eckey} {
+		if w := do(http.MethodGet, "/api?action=search&q=test", "Authorization", "Bearer "+signJWT(t, "", key, claims(nil))); w.Code != http.StatusOK {
+			t.Log("valid JWT is not accepted:", w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+	if w := do(http.MethodGet, "/api?action=search&q=test", "Notepet-Token", "static-token"); w.Code != http.StatusOK {
+		t.Log("static token is not accepted along with JWTs:", w.Code)
+		t.Fail()
+	}
+	otherkey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	invalid := map[string]string{
+		"expired":         signJWT(t, "rsa", rsakey, claims(func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"without expiry":  signJWT(t, "rsa", rsakey, claims(func(c map[string]interface{}) { delete(c, "exp") })),
+		"wrong issuer":    signJWT(t, "rsa", rsakey, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })),
+		"wrong audience":  signJWT(t, "rsa", rsakey, claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+		"unknown key":     signJWT(t, "", otherkey, claims(nil)),
+		"key of other id": signJWT(t, "ec", rsakey, claims(nil)),
+		"HMAC with public key": signJWT(t, "", func() []byte {
+			der, _ := x509.MarshalPKIXPublicKey(&rsakey.PublicKey)
+			return der
+		}(), claims(nil)),
+		"without user":       signJWT(t, "", rsakey, claims(func(c map[string]interface{}) { delete(c, "sub") })),
+		"without own scope":  signJWT(t, "", rsakey, claims(func(c map[string]interface{}) { c["scope"] = "openid profile" })),
+		"with group as user": signJWT(t, "", rsakey, claims(func(c map[string]interface{}) { c["sub"] = GroupPrefix + "ops" })),
+		"malformed":          "not.a.jwt",
+	}
+	for name, token := range invalid {
+		for _, target := range []string{"/api/v2/notes?q=test", "/api?action=search&q=test"} {
+			if w := do(http.MethodGet, target, "Authorization", "Bearer "+token); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+				t.Log("JWT", name, "is accepted or challenge is missing:", target, w.Code, w.Header())
+				t.Fail()
+			}
+		}
+	}
+	if w := do(http.MethodGet, "/api/v2/notes?q=test", "Notepet-Token", "wrong-token"); w.Code != http.StatusForbidden || w.Header().Get("WWW-Authenticate") != "" {
+		t.Log("invalid static token is not forbidden:", w.Code, w.Header())
+		t.Fail()
+	}
+	scoped := signJWT(t, "", eckey, claims(func(c map[string]interface{}) { c["scope"] = "openid notes:read" }))
+	if w := do(http.MethodDelete, "/api/v2/notes/1", "Authorization", "Bearer "+scoped); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), ScopeNotesDelete) {
+		t.Log("scopes of JWT are not enforced:", w.Code, w.Body.String())
+		t.Fail()
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/api", nil)
+	req.Header.Set("Authorization", "Bearer "+signJWT(t, "rsa", rsakey, claims(nil)))
+	u, err := NewJWTAuthenticator(keys, "", "").Authenticate(req)
+	if err != nil || u.Name != "alice" || !u.IsAdmin() || len(u.Groups) != 1 || u.Groups[0] != "ops" || len(u.Scopes) != 0 {
+		t.Log("claims are not mapped to user:", u, err)
+		t.Fail()
+	}
+	u, err = NewJWTAuthenticator(keys, "", "").Authenticate(httptest.NewRequest(http.MethodGet, "http://example.com/api", nil))
+	if err != ErrNoCredentials {
+		t.Log("request without JWT is not reported as such:", u, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,514 @@
+package notepet
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// apiV2Prefix is the base path of RESTful version of API
+const apiV2Prefix = "/api/v2"
+
+// apiError is a body of error response returned by v2 API
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// serveV2 routes requests to /api/v2/notes, /api/v2/notes/{id} etc.
+func (ah *APIHandler) serveV2(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, apiV2Prefix), "/")
+	parts := strings.Split(path, "/")
+	for i := range parts {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil || part == "" {
+			writeAPIError(w, "not found", http.StatusNotFound)
+			return
+		}
+		parts[i] = part
+	}
+	var methods map[string]http.HandlerFunc
+	switch {
+	case len(parts) == 1 && parts[0] == "notes":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet:  ah.handleV2List,
+			http.MethodPost: ah.handleV2Create,
+		}
+	case len(parts) == 2 && parts[0] == "notes":
+		id := NoteID(parts[1])
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet:    func(w http.ResponseWriter, r *http.Request) { ah.handleV2Get(w, r, id) },
+			http.MethodPut:    func(w http.ResponseWriter, r *http.Request) { ah.handleV2Update(w, r, id) },
+			http.MethodPatch:  func(w http.ResponseWriter, r *http.Request) { ah.handleV2Patch(w, r, id) },
+			http.MethodDelete: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Delete(w, r, id) },
+		}
+	case len(parts) >= 3 && len(parts) <= 4 && parts[0] == "notes" && parts[2] == "revisions":
+		id, rev := NoteID(parts[1]), ""
+		if len(parts) == 4 {
+			rev = parts[3]
+		}
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Revisions(w, r, id, rev) },
+		}
+	case len(parts) == 3 && parts[0] == "notes" && parts[2] == "shares":
+		id := NoteID(parts[1])
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Shares(w, r, id) },
+		}
+	case len(parts) == 4 && parts[0] == "notes" && parts[2] == "shares":
+		id, grantee := NoteID(parts[1]), parts[3]
+		methods = map[string]http.HandlerFunc{
+			http.MethodPut:    func(w http.ResponseWriter, r *http.Request) { ah.handleV2Share(w, r, id, grantee) },
+			http.MethodDelete: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Unshare(w, r, id, grantee) },
+		}
+	case len(parts) == 1 && parts[0] == "shares":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Shares(w, r, "") },
+		}
+	case len(parts) == 1 && parts[0] == "tags":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: ah.handleV2Tags,
+		}
+	case len(parts) == 1 && parts[0] == "events":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: func(w http.ResponseWriter, r *http.Request) { serveEvents(w, r, ah.Events, ah.eventFilter(r)) },
+		}
+	case len(parts) == 1 && parts[0] == "changes":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet: ah.handleV2Changes,
+		}
+	case len(parts) == 1 && parts[0] == "trash":
+		methods = map[string]http.HandlerFunc{
+			http.MethodGet:    ah.handleV2Trash,
+			http.MethodDelete: ah.handleV2EmptyTrash,
+		}
+	case len(parts) == 3 && parts[0] == "trash" && parts[2] == "restore":
+		id := NoteID(parts[1])
+		methods = map[string]http.HandlerFunc{
+			http.MethodPost: func(w http.ResponseWriter, r *http.Request) { ah.handleV2Undelete(w, r, id) },
+		}
+	default:
+		writeAPIError(w, "not found", http.StatusNotFound)
+		return
+	}
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := []string{}
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ah.authenticateV2(scopeV2(r.Method, parts), handler)(w, r)
+}
+
+// scopeV2 returns scope needed for request to resource at path parts
+func scopeV2(method string, parts []string) string {
+	switch {
+	case method == http.MethodGet:
+		return ScopeNotesRead
+	case method == http.MethodDelete && parts[0] == "trash":
+		return ScopeAdmin
+	case method == http.MethodDelete && len(parts) == 2:
+		return ScopeNotesDelete
+	}
+	return ScopeNotesWrite
+}
+
+func (ah *APIHandler) authenticateV2(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := ah.authenticator().Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			writeAPIError(w, "missing Notepet-Token or Authorization header", http.StatusUnauthorized)
+			return
+		} else if err == ErrInvalidCredentials {
+			writeAPIError(w, "invalid token", http.StatusForbidden)
+			return
+		} else if err != nil {
+			writeAPIError(w, err.Error(), rejectCredentials(w, err))
+			return
+		}
+		if !u.HasScope(scope) {
+			writeAPIError(w, missingScope(scope), http.StatusForbidden)
+			return
+		}
+		h(w, withUser(r, u))
+	}
+}
+
+func (ah *APIHandler) handleV2List(w http.ResponseWriter, r *http.Request) {
+	tags, all := parseTagQuery(r)
+	if q := r.URL.Query().Get("q"); q != "" {
+		if _, err := ParseQuery(q); err != nil {
+			writeAPIError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results, err := SearchRanked(ah.storage(r), q)
+		if err != nil && err != ErrNoNotesFound {
+			writeAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSONStream(w, r, nil, func(write func(interface{}) error) error {
+			for _, result := range results {
+				if len(tags) > 0 && !result.HasTags(tags, all) {
+					continue
+				}
+				if err := write(result); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return
+	}
+	opts, err := parseListOptions(r)
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	each := streamAll(ah.storage(r))
+	if !isFullList(opts) {
+		page, err := List(ah.storage(r), opts)
+		if err != nil {
+			writeAPIError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setPageHeaders(w, page)
+		each = streamList(page.Notes)
+	}
+	if err := writeJSONStream(w, r, nil, each); err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ah *APIHandler) handleV2Get(w http.ResponseWriter, r *http.Request, id NoteID) {
+	notes, err := ah.storage(r).Get(id)
+	if err != nil || len(notes) == 0 {
+		writeAPIError(w, ErrNoNotesFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("ETag", notes[0].ETag())
+	writeAPIJSON(w, http.StatusOK, notes[0])
+}
+
+func (ah *APIHandler) handleV2Create(w http.ResponseWriter, r *http.Request) {
+	note, ok := readAPINote(w, r)
+	if !ok {
+		return
+	}
+	id, err := ah.put(r, note)
+	if err == ErrCanNotAddEmptyNote {
+		writeAPIError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err == ErrNoteExists {
+		writeAPIError(w, err.Error(), http.StatusConflict)
+		return
+	} else if err == ErrBadNoteID {
+		writeAPIError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if created, err := ah.storage(r).Get(id); err == nil && len(created) > 0 {
+		note = created[0]
+	} else {
+		note.ID = id
+	}
+	ah.publish(EventCreated, id)
+	w.Header().Set("Location", apiV2Prefix+"/notes/"+url.PathEscape(id.String()))
+	w.Header().Set("ETag", note.ETag())
+	writeAPIJSON(w, http.StatusCreated, note)
+}
+
+func (ah *APIHandler) handleV2Update(w http.ResponseWriter, r *http.Request, id NoteID) {
+	note, ok := readAPINote(w, r)
+	if !ok {
+		return
+	}
+	ah.writeMu.Lock()
+	defer ah.writeMu.Unlock()
+	if !ah.checkV2Precondition(w, r, id) {
+		return
+	}
+	wasSticky := ah.isSticky(id)
+	newID, err := ah.storage(r).Upd(id, note)
+	if err == ErrNoNotesFound {
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err == ErrCanNotAddEmptyNote {
+		writeAPIError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if err == ErrPermissionDenied {
+		writeAPIError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ah.publishUpdate(newID, wasSticky)
+	ah.handleV2Get(w, r, newID)
+}
+
+func (ah *APIHandler) handleV2Patch(w http.ResponseWriter, r *http.Request, id NoteID) {
+	data, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeAPIError(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+	var patch NotePatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		writeAPIError(w, "could not parse request body", http.StatusBadRequest)
+		return
+	}
+	ah.writeMu.Lock()
+	defer ah.writeMu.Unlock()
+	if !ah.checkV2Precondition(w, r, id) {
+		return
+	}
+	wasSticky := ah.isSticky(id)
+	newID, err := PatchNote(ah.storage(r), id, patch)
+	switch err {
+	case nil:
+		ah.publishUpdate(newID, wasSticky)
+		ah.handleV2Get(w, r, newID)
+	case ErrNoNotesFound:
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+	case ErrCanNotAddEmptyNote:
+		writeAPIError(w, err.Error(), http.StatusUnprocessableEntity)
+	case ErrPermissionDenied:
+		writeAPIError(w, err.Error(), http.StatusForbidden)
+	default:
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ah *APIHandler) handleV2Delete(w http.ResponseWriter, r *http.Request, id NoteID) {
+	ah.writeMu.Lock()
+	defer ah.writeMu.Unlock()
+	if !ah.checkV2Precondition(w, r, id) {
+		return
+	}
+	if err := ah.storage(r).Del(id); err == ErrPermissionDenied {
+		writeAPIError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err == ErrNoNotesFound {
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ah.publish(EventDeleted, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *APIHandler) handleV2Revisions(w http.ResponseWriter, r *http.Request, id NoteID, rev string) {
+	hs, ok := ah.storage(r).(HistoryStorage)
+	if !ok {
+		writeAPIError(w, "storage does not keep history", http.StatusNotImplemented)
+		return
+	}
+	if rev == "" {
+		revisions, err := hs.History(id)
+		if err != nil {
+			writeAPIError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, revisions)
+		return
+	}
+	n, err := strconv.Atoi(rev)
+	if err != nil {
+		writeAPIError(w, "invalid revision", http.StatusBadRequest)
+		return
+	}
+	revision, err := hs.Revision(id, n)
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, revision)
+}
+
+func (ah *APIHandler) handleV2Shares(w http.ResponseWriter, r *http.Request, id NoteID) {
+	shares, err := ah.shares(r, id)
+	if err != nil {
+		writeAPIError(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, shares)
+}
+
+func (ah *APIHandler) handleV2Share(w http.ResponseWriter, r *http.Request, id NoteID, grantee string) {
+	share := Share{Access: AccessRead}
+	data, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeAPIError(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &share); err != nil {
+			writeAPIError(w, "could not parse request body", http.StatusBadRequest)
+			return
+		}
+	}
+	share.ID, share.Grantee = id, grantee
+	if err := ah.share(r, share); err != nil {
+		writeAPIError(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, share)
+}
+
+func (ah *APIHandler) handleV2Unshare(w http.ResponseWriter, r *http.Request, id NoteID, grantee string) {
+	if err := ah.unshare(r, id, grantee); err != nil {
+		writeAPIError(w, err.Error(), shareErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *APIHandler) handleV2Tags(w http.ResponseWriter, r *http.Request) {
+	counts, err := listTags(ah.storage(r))
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, counts)
+}
+
+func (ah *APIHandler) handleV2Changes(w http.ResponseWriter, r *http.Request) {
+	feed, status, err := ah.changeFeed(r)
+	if err != nil {
+		writeAPIError(w, err.Error(), status)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, feed)
+}
+
+func (ah *APIHandler) handleV2Trash(w http.ResponseWriter, r *http.Request) {
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		writeAPIError(w, "storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	notes, err := ts.Trash()
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, notes)
+}
+
+func (ah *APIHandler) handleV2Undelete(w http.ResponseWriter, r *http.Request, id NoteID) {
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		writeAPIError(w, "storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	switch err := ts.Undelete(id); err {
+	case nil:
+		ah.publish(EventCreated, id)
+		w.Header().Set("Location", apiV2Prefix+"/notes/"+url.PathEscape(id.String()))
+		ah.handleV2Get(w, r, id)
+	case ErrNoNotesFound:
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+	case ErrNoteExists:
+		writeAPIError(w, err.Error(), http.StatusConflict)
+	default:
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ah *APIHandler) handleV2EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	before, err := parseTrashBefore(r)
+	if err != nil {
+		writeAPIError(w, "invalid before parameter", http.StatusBadRequest)
+		return
+	}
+	ts, ok := ah.storage(r).(TrashStorage)
+	if !ok {
+		writeAPIError(w, "storage does not keep trash", http.StatusNotImplemented)
+		return
+	}
+	n, err := ts.EmptyTrash(before)
+	if err == ErrPermissionDenied {
+		writeAPIError(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, map[string]int{"removed": n})
+}
+
+// checkV2Precondition makes sure note with id exists and matches
+// If-Match header of request if one is present. Otherwise it writes
+// error to w and returns false. Caller should hold ah.writeMu.
+func (ah *APIHandler) checkV2Precondition(w http.ResponseWriter, r *http.Request, id NoteID) bool {
+	if notes, err := ah.storage(r).Get(id); err != nil || len(notes) != 1 {
+		writeAPIError(w, ErrNoNotesFound.Error(), http.StatusNotFound)
+		return false
+	}
+	switch err := ah.ifMatch(r, id).(type) {
+	case nil:
+		return true
+	case *ConflictError:
+		w.Header().Set("ETag", err.ETag)
+		writeAPIError(w, "note has been modified", http.StatusPreconditionFailed)
+	default:
+		writeAPIError(w, err.Error(), http.StatusNotFound)
+	}
+	return false
+}
+
+// readAPINote parses note from request body. If body could not be
+// parsed it writes error to w and returns false.
+func readAPINote(w http.ResponseWriter, r *http.Request) (Note, bool) {
+	data, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		writeAPIError(w, "could not read request body", http.StatusBadRequest)
+		return Note{}, false
+	}
+	note, err := bytesToNote(data)
+	if err != nil {
+		writeAPIError(w, "could not parse request body", http.StatusBadRequest)
+		return Note{}, false
+	}
+	return note, true
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		writeAPIError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeAPIError(w http.ResponseWriter, msg string, status int) {
+	data, _ := json.Marshal(apiError{Error: apiErrorBody{Status: status, Message: msg}})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -1,7 +1,469 @@
 package notepet
 
-import "net/http"
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
 
+// webTokenCookie is the name of cookie holding token of web interface user
+const webTokenCookie = "notepet-token"
+
+// WebHandler implements http.Handler serving html interface to notes.
+// It uses Storage and tokens of the APIHandler it has been created with.
+type WebHandler struct {
+	api *APIHandler
+}
+
+// NewWebHandler returns instance of http.Handler serving web interface
+// under /notes path.
+func NewWebHandler(ah *APIHandler) (*WebHandler, error) {
+	if ah == nil || ah.Storage == nil {
+		return nil, ErrStorageIsNil
+	}
+	return &WebHandler{api: ah}, nil
+}
+
+// defaultWebHandler is web interface served by the last server created
+// with NewNotepetServer. It is used by HandleWeb.
+var defaultWebHandler = struct {
+	sync.RWMutex
+	wh *WebHandler
+}{}
+
+// setDefaultWebHandler makes wh served by HandleWeb
+func setDefaultWebHandler(wh *WebHandler) {
+	defaultWebHandler.Lock()
+	defer defaultWebHandler.Unlock()
+	defaultWebHandler.wh = wh
+}
+
+// HandleWeb serves web interface of the last server created with
+// NewNotepetServer (with handleweb set). It responds with 404 Not Found
+// if there is no such server.
+//
+// Deprecated: use NewWebHandler to serve notes of particular APIHandler.
 func HandleWeb(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("web interface is currently down"))
+	defaultWebHandler.RLock()
+	wh := defaultWebHandler.wh
+	defaultWebHandler.RUnlock()
+	if wh == nil {
+		http.Error(w, "404 web interface is not served", http.StatusNotFound)
+		return
+	}
+	wh.ServeHTTP(w, r)
+}
+
+// ServeHTTP implements http.Handler interface
+func (wh *WebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/notes"), "/")
+	action, arg := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		action, arg = path[:i], path[i+1:]
+	}
+	switch action {
+	case "login":
+		wh.handleWebLogin(w, r)
+		return
+	case "logout":
+		wh.handleWebLogout(w, r)
+		return
+	}
+	u, ok := wh.user(r)
+	if !ok {
+		http.Redirect(w, r, "/notes/login", http.StatusSeeOther)
+		return
+	}
+	if scope := webScope(action, arg); !u.HasScope(scope) {
+		webError(w, "403 Forbidden: "+missingScope(scope), http.StatusForbidden)
+		return
+	}
+	r = withUser(r, u)
+	switch {
+	case action == "":
+		wh.handleWebList(w, r)
+	case action == "new":
+		wh.handleWebNew(w, r)
+	case action == "events":
+		serveEvents(w, r, wh.api.Events, wh.api.eventFilter(r))
+	case action == "search":
+		wh.handleWebSearch(w, r, arg)
+	case action == "edit" && arg != "":
+		wh.handleWebEdit(w, r, NoteID(arg))
+	case action == "del" && arg != "":
+		wh.handleWebDel(w, r, NoteID(arg))
+	case action == "sticky" && arg != "":
+		wh.handleWebSticky(w, r, NoteID(arg))
+	case arg == "":
+		wh.handleWebShow(w, r, NoteID(action))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// webScope returns scope needed for action of web interface
+func webScope(action, arg string) string {
+	switch {
+	case action == "new", action == "edit" && arg != "", action == "sticky" && arg != "":
+		return ScopeNotesWrite
+	case action == "del" && arg != "":
+		return ScopeNotesDelete
+	}
+	return ScopeNotesRead
+}
+
+// user returns account authenticated by token cookie of request
+func (wh *WebHandler) user(r *http.Request) (User, bool) {
+	cookie, err := r.Cookie(webTokenCookie)
+	if err != nil {
+		return User{}, false
+	}
+	return wh.api.user(cookie.Value)
+}
+
+func (wh *WebHandler) handleWebLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		wh.render(w, "login", webPage{Title: "Login"})
+	case http.MethodPost:
+		token := r.PostFormValue("token")
+		if !wh.api.validToken(token) {
+			w.WriteHeader(http.StatusForbidden)
+			wh.render(w, "login", webPage{Title: "Login", Message: "invalid token"})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     webTokenCookie,
+			Value:    token,
+			Path:     "/notes",
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/notes", http.StatusSeeOther)
+	default:
+		webMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (wh *WebHandler) handleWebLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   webTokenCookie,
+		Value:  "",
+		Path:   "/notes",
+		MaxAge: -1,
+	})
+	http.Redirect(w, r, "/notes/login", http.StatusSeeOther)
+}
+
+func (wh *WebHandler) handleWebList(w http.ResponseWriter, r *http.Request) {
+	notes, err := wh.api.storage(r).Get()
+	page := webPage{Title: "Notes", Notes: notes}
+	if err != nil && err != ErrNoNotesFound {
+		page.Message = err.Error()
+	}
+	wh.render(w, "list", page)
+}
+
+func (wh *WebHandler) handleWebShow(w http.ResponseWriter, r *http.Request, id NoteID) {
+	note, ok := wh.getNote(w, r, id)
+	if !ok {
+		return
+	}
+	wh.render(w, "show", webPage{Title: note.Title, Note: note})
+}
+
+func (wh *WebHandler) handleWebNew(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		wh.render(w, "edit", webPage{Title: "New note", Action: "/notes/new"})
+	case http.MethodPost:
+		note := noteFromForm(r)
+		id, err := wh.api.put(r, note)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			wh.render(w, "edit", webPage{Title: "New note", Action: "/notes/new", Note: note, Message: err.Error()})
+			return
+		}
+		wh.api.publish(EventCreated, id)
+		http.Redirect(w, r, "/notes/"+url.PathEscape(id.String()), http.StatusSeeOther)
+	default:
+		webMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (wh *WebHandler) handleWebEdit(w http.ResponseWriter, r *http.Request, id NoteID) {
+	action := "/notes/edit/" + url.PathEscape(id.String())
+	switch r.Method {
+	case http.MethodGet:
+		note, ok := wh.getNote(w, r, id)
+		if !ok {
+			return
+		}
+		wh.render(w, "edit", webPage{Title: "Edit note", Action: action, Note: note, ETag: note.ETag()})
+	case http.MethodPost:
+		note := noteFromForm(r)
+		wh.api.writeMu.Lock()
+		defer wh.api.writeMu.Unlock()
+		if current, ok := wh.checkETag(w, r, id); !ok {
+			if current.ID != "" {
+				// keep changes of user and show what they would overwrite
+				wh.render(w, "edit", webPage{Title: "Edit note", Action: action, Note: note, ETag: current.ETag(),
+					Current: &current, Message: webConflictMessage + " Save again to overwrite it."})
+			}
+			return
+		}
+		wasSticky := wh.api.isSticky(id)
+		newID, err := wh.api.storage(r).Upd(id, note)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			wh.render(w, "edit", webPage{Title: "Edit note", Action: action, Note: note, ETag: r.PostFormValue("etag"), Message: err.Error()})
+			return
+		}
+		wh.api.publishUpdate(newID, wasSticky)
+		http.Redirect(w, r, "/notes/"+url.PathEscape(newID.String()), http.StatusSeeOther)
+	default:
+		webMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (wh *WebHandler) handleWebDel(w http.ResponseWriter, r *http.Request, id NoteID) {
+	switch r.Method {
+	case http.MethodGet:
+		note, ok := wh.getNote(w, r, id)
+		if !ok {
+			return
+		}
+		wh.render(w, "delete", webPage{Title: "Delete note", Note: note, ETag: note.ETag()})
+	case http.MethodPost:
+		wh.api.writeMu.Lock()
+		defer wh.api.writeMu.Unlock()
+		if current, ok := wh.checkETag(w, r, id); !ok {
+			if current.ID != "" {
+				wh.render(w, "delete", webPage{Title: "Delete note", Note: current, ETag: current.ETag(),
+					Message: webConflictMessage + " Delete it anyway?"})
+			}
+			return
+		}
+		if err := wh.api.storage(r).Del(id); err != nil {
+			webError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wh.api.publish(EventDeleted, id)
+		http.Redirect(w, r, "/notes", http.StatusSeeOther)
+	default:
+		webMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
 }
+
+func (wh *WebHandler) handleWebSticky(w http.ResponseWriter, r *http.Request, id NoteID) {
+	if r.Method != http.MethodPost {
+		webMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	note, ok := wh.getNote(w, r, id)
+	if !ok {
+		return
+	}
+	sticky := !note.Sticky
+	if _, err := PatchNote(wh.api.storage(r), id, NotePatch{Sticky: &sticky}); err != nil {
+		webError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wh.api.publishUpdate(id, note.Sticky)
+	http.Redirect(w, r, "/notes", http.StatusSeeOther)
+}
+
+func (wh *WebHandler) handleWebSearch(w http.ResponseWriter, r *http.Request, query string) {
+	if q := r.URL.Query().Get("q"); q != "" {
+		http.Redirect(w, r, "/notes/search/"+url.PathEscape(q), http.StatusSeeOther)
+		return
+	}
+	if query == "" {
+		http.Redirect(w, r, "/notes", http.StatusSeeOther)
+		return
+	}
+	notes, err := wh.api.storage(r).Search(query)
+	page := webPage{Title: "Search: " + query, Query: query, Notes: notes}
+	if err != nil {
+		page.Message = "nothing found"
+	}
+	wh.render(w, "list", page)
+}
+
+// webConflictMessage tells user that note has been changed
+// since the page they have submitted was rendered
+const webConflictMessage = "Note has been modified since you opened it."
+
+// checkETag compares etag field of submitted form with ETag of current
+// version of note with id. If they do not match it writes 409 Conflict
+// header and returns current version of note to be shown to user along
+// with false. If note is missing it writes 404 Not Found and returns
+// empty note. Caller should hold wh.api.writeMu.
+func (wh *WebHandler) checkETag(w http.ResponseWriter, r *http.Request, id NoteID) (Note, bool) {
+	err := wh.api.matchETag(r, id, r.PostFormValue("etag"))
+	if err == nil {
+		return Note{}, true
+	}
+	if _, ok := err.(*ConflictError); ok {
+		if current, ok := wh.getNote(w, r, id); ok {
+			w.WriteHeader(http.StatusConflict)
+			return current, false
+		}
+		return Note{}, false
+	}
+	http.NotFound(w, r)
+	return Note{}, false
+}
+
+// getNote fetches note with id from storage. If note could not be fetched
+// it writes error to w and returns false.
+func (wh *WebHandler) getNote(w http.ResponseWriter, r *http.Request, id NoteID) (Note, bool) {
+	notes, err := wh.api.storage(r).Get(id)
+	if err != nil || len(notes) == 0 {
+		http.NotFound(w, r)
+		return Note{}, false
+	}
+	return notes[0], true
+}
+
+func (wh *WebHandler) render(w http.ResponseWriter, name string, page webPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webTemplates.ExecuteTemplate(w, name, page); err != nil {
+		log.Printf("error rendering template %v: %v\n", name, err)
+	}
+}
+
+func noteFromForm(r *http.Request) (note Note) {
+	note.Title = strings.TrimSpace(r.PostFormValue("title"))
+	note.Body = strings.TrimRight(strings.ReplaceAll(r.PostFormValue("body"), "\r\n", "\n"), " \n")
+	note.Tags = strings.TrimSpace(r.PostFormValue("tags"))
+	note.Sticky = r.PostFormValue("sticky") != ""
+	return
+}
+
+func webMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	webError(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func webError(w http.ResponseWriter, msg string, code int) {
+	http.Error(w, msg, code)
+}
+
+// webPage holds data passed to templates
+type webPage struct {
+	Title   string
+	Message string
+	Query   string
+	Action  string
+	ETag    string // version of Note being edited or deleted
+	Note    Note
+	Current *Note // version of Note changed by someone else meanwhile
+	Notes   []Note
+}
+
+var webTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"date": func(n Note) string { return n.LastEdited.Format("02/01/2006 15:04:05") },
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>notepet: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+nav form { display: inline; }
+.note { border: 1px solid #ccc; border-radius: 4px; padding: 0.5em 1em; margin: 0.5em 0; }
+.sticky { border-color: #c90; background: #fff8e0; }
+.meta, .tags { color: #777; font-size: 0.9em; }
+.body { white-space: pre-wrap; }
+.message { color: #c00; }
+.actions form { display: inline; }
+textarea, input[type=text] { width: 100%; box-sizing: border-box; }
+</style>
+</head>
+<body>
+<nav>
+<a href="/notes">all notes</a> | <a href="/notes/new">new note</a> |
+<form action="/notes/search" method="get"><input name="q" value="{{.Query}}" placeholder="search"></form> |
+<a href="/notes/logout">logout</a>
+</nav>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}
+</body>
+</html>
+{{end}}
+
+{{define "note"}}
+<div class="note{{if .Sticky}} sticky{{end}}">
+<p class="meta">{{if .Sticky}}<b>STICKY</b> {{end}}{{date .}}</p>
+{{if .Title}}<h3><a href="/notes/{{.ID}}">{{.Title}}</a></h3>{{end}}
+<div class="body">{{.Body}}</div>
+{{if .Tags}}<p class="tags">&gt; {{.Tags}} &lt;</p>{{end}}
+<p class="actions">
+<a href="/notes/{{.ID}}">view</a> |
+<a href="/notes/edit/{{.ID}}">edit</a> |
+<form action="/notes/sticky/{{.ID}}" method="post"><button>{{if .Sticky}}unpin{{else}}pin{{end}}</button></form> |
+<a href="/notes/del/{{.ID}}">delete</a>
+</p>
+</div>
+{{end}}
+
+{{define "list"}}{{template "header" .}}
+<h2>{{.Title}}</h2>
+{{range .Notes}}{{template "note" .}}{{else}}<p>no notes</p>{{end}}
+<script>
+// reload list when someone changes notes
+if (window.EventSource) {
+	var events = new EventSource("/notes/events");
+	["created", "updated", "deleted"].forEach(function(type) {
+		events.addEventListener(type, function() { location.reload(); });
+	});
+}
+</script>
+{{template "footer"}}{{end}}
+
+{{define "show"}}{{template "header" .}}
+{{template "note" .Note}}
+<p class="meta">ID: {{.Note.ID}}<br>Created: {{.Note.TimeStamp.Format "02/01/2006 15:04:05"}}</p>
+{{template "footer"}}{{end}}
+
+{{define "edit"}}{{template "header" .}}
+<h2>{{.Title}}</h2>
+{{if .Current}}<h3>Current version</h3>
+{{template "note" .Current}}
+<h3>Your version</h3>{{end}}
+<form action="{{.Action}}" method="post">
+{{if .ETag}}<input type="hidden" name="etag" value="{{.ETag}}">{{end}}
+<p><input type="text" name="title" value="{{.Note.Title}}" placeholder="title"></p>
+<p><textarea name="body" rows="12" placeholder="note">{{.Note.Body}}</textarea></p>
+<p><input type="text" name="tags" value="{{.Note.Tags}}" placeholder="tags"></p>
+<p><label><input type="checkbox" name="sticky"{{if .Note.Sticky}} checked{{end}}> sticky</label></p>
+<p><button>save</button></p>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "delete"}}{{template "header" .}}
+<h2>Delete this note?</h2>
+{{template "note" .Note}}
+<form action="/notes/del/{{.Note.ID}}" method="post"><input type="hidden" name="etag" value="{{.ETag}}"><button>delete</button> <a href="/notes">cancel</a></form>
+{{template "footer"}}{{end}}
+
+{{define "login"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>notepet: login</title></head>
+<body>
+{{if .Message}}<p style="color: #c00">{{.Message}}</p>{{end}}
+<form action="/notes/login" method="post">
+<p><input type="password" name="token" placeholder="token"> <button>login</button></p>
+</form>
+</body>
+</html>
+{{end}}
+`))
@@ -0,0 +1,148 @@
+package notepet
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Access granted to note by Share
+const (
+	AccessRead      = "r"  // note can be read
+	AccessReadWrite = "rw" // note can be read and updated
+)
+
+// GroupPrefix starts grantee of Share which is a group of users
+// rather than single user (e.g. "@devops").
+const GroupPrefix = "@"
+
+// ErrBadShare is returned when Share has no grantee or unknown access
+var ErrBadShare = errors.New("error: share needs grantee and access r or rw")
+
+// Share grants user or group access to note owned by someone else
+type Share struct {
+	ID      NoteID `json:"id"`
+	Grantee string `json:"grantee"` // user name or GroupPrefix and group name
+	Access  string `json:"access"`
+}
+
+// validate returns ErrBadShare if s can not be granted
+func (s Share) validate() error {
+	if strings.TrimPrefix(s.Grantee, GroupPrefix) == "" || strings.ContainsAny(s.Grantee, " \t\n,:") {
+		return ErrBadShare
+	}
+	if s.Access != AccessRead && s.Access != AccessReadWrite {
+		return ErrBadShare
+	}
+	return nil
+}
+
+// ShareStorage is implemented by Storage which keeps shares of notes.
+// Shares of notes in trash are kept so that they are back if note is
+// restored. They are removed when trash is emptied.
+type ShareStorage interface {
+	// Shares returns shares of Note with NoteID.
+	Shares(NoteID) ([]Share, error)
+	// SharedWith returns shares granted to any of grantees.
+	SharedWith([]string) ([]Share, error)
+	// Share grants access to note replacing earlier share of
+	// the note to the same grantee. Note should exist.
+	Share(Share) error
+	// Unshare revokes access of grantee to Note with NoteID.
+	Unshare(NoteID, string) error
+}
+
+// grantees returns names under which shares to u are granted
+func (u User) grantees() []string {
+	names := []string{u.Name}
+	for _, group := range u.Groups {
+		names = append(names, GroupPrefix+group)
+	}
+	return names
+}
+
+// sharedAccess returns best access to notes granted by shares
+func sharedAccess(shares []Share) map[NoteID]string {
+	access := make(map[NoteID]string)
+	for _, s := range shares {
+		if access[s.ID] != AccessReadWrite {
+			access[s.ID] = s.Access
+		}
+	}
+	return access
+}
+
+// errNoShares is returned when storage does not keep shares
+var errNoShares = errors.New("error: storage does not keep shares")
+
+// shares returns shares of note with id or, if id is empty, shares
+// granted to grantees listed in "grantee" parameter of request
+// (user who has made request and their groups by default).
+func (ah *APIHandler) shares(r *http.Request, id NoteID) ([]Share, error) {
+	ss, ok := ah.storage(r).(ShareStorage)
+	if !ok {
+		return []Share{}, errNoShares
+	}
+	if id != "" {
+		return ss.Shares(id)
+	}
+	grantees := requestUser(r).grantees()
+	if g := r.URL.Query().Get("grantee"); g != "" {
+		grantees = strings.Split(g, ",")
+	}
+	return ss.SharedWith(grantees)
+}
+
+// share grants access to note on behalf of user who has made request
+func (ah *APIHandler) share(r *http.Request, s Share) error {
+	ss, ok := ah.storage(r).(ShareStorage)
+	if !ok {
+		return errNoShares
+	}
+	if err := s.validate(); err != nil {
+		return err
+	}
+	return ss.Share(s)
+}
+
+// unshare revokes access to note on behalf of user who has made request
+func (ah *APIHandler) unshare(r *http.Request, id NoteID, grantee string) error {
+	ss, ok := ah.storage(r).(ShareStorage)
+	if !ok {
+		return errNoShares
+	}
+	return ss.Unshare(id, grantee)
+}
+
+// shareErrorStatus returns HTTP status reporting error of share operation
+func shareErrorStatus(err error) int {
+	switch err {
+	case errNoShares:
+		return http.StatusNotImplemented
+	case ErrBadShare:
+		return http.StatusBadRequest
+	case ErrNoNotesFound:
+		return http.StatusNotFound
+	case ErrPermissionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// scanShares reads rows of shares (id, grantee, access) and closes rows
+func scanShares(rows *sql.Rows, err error) ([]Share, error) {
+	shares := []Share{}
+	if err != nil {
+		return shares, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s Share
+		if err := rows.Scan(&s.ID, &s.Grantee, &s.Access); err != nil {
+			return shares, err
+		}
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
@@ -1,6 +1,11 @@
 package notepet
 
-import "errors"
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
 
 var (
 	// ErrNoNotesFound when no notes with requested NoteID are found in the storage
@@ -13,6 +18,17 @@ var (
 	ErrStorageIsNil = errors.New("can not use storage: storage is nil")
 )
 
+// ConflictError is returned when Note has been modified by someone
+// else since the version the requested change is based on.
+type ConflictError struct {
+	ID   NoteID
+	ETag string // ETag of the current version of Note (may be empty)
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("error: note %v has been modified concurrently", e.ID)
+}
+
 //Storage interface represents any type of storage for Note objects.
 type Storage interface {
 	// Get signature is intended to accept zero or one NoteID
@@ -20,7 +36,9 @@ type Storage interface {
 	// return second and subsequent ids depending on implementation
 	Get(...NoteID) ([]Note, error)
 	// Put accepts Note and should return NoteID if Note has been
-	// successfully added to Storage
+	// successfully added to Storage. If Note has ID set it is kept
+	// (ErrNoteExists is returned if it is already taken by a note,
+	// note in trash or history of one), otherwise new ID is generated.
 	Put(Note) (NoteID, error)
 	// Upd accepts Note and should return NoteID if Note has been
 	// successfully modified in Storage
@@ -37,36 +55,98 @@ type Storage interface {
 	Close() error
 }
 
-// Migrate copies all notes from src (source) Storage
-// to dst (destination) Storage. If succesful the returned
-// error in nil.
-func Migrate(dst, src Storage) error {
-	if src == nil || dst == nil {
-		return ErrStorageIsNil
+// ConditionalUpdater is implemented by Storage supporting optimistic
+// concurrency control. Methods accept ETag of the version of Note the
+// change is based on and return *ConflictError if it is not current.
+type ConditionalUpdater interface {
+	UpdIfMatch(NoteID, Note, string) (NoteID, error)
+	DelIfMatch(NoteID, string) error
+}
+
+// NotePatch holds new values of Note fields for partial update.
+// Fields which are nil are left unchanged.
+type NotePatch struct {
+	Title  *string `json:"title,omitempty"`
+	Body   *string `json:"body,omitempty"`
+	Tags   *string `json:"tags,omitempty"`
+	Sticky *bool   `json:"sticky,omitempty"`
+}
+
+// Apply returns copy of n with fields set in patch replaced
+func (p NotePatch) Apply(n Note) Note {
+	if p.Title != nil {
+		n.Title = *p.Title
+	}
+	if p.Body != nil {
+		n.Body = *p.Body
+	}
+	if p.Tags != nil {
+		n.Tags = *p.Tags
 	}
-	sourcenotes, err := src.Get()
+	if p.Sticky != nil {
+		n.Sticky = *p.Sticky
+	}
+	return n
+}
+
+// columns returns names of database columns modified by patch
+// and their new values. LastEdited is always included.
+func (p NotePatch) columns(lastedited time.Time) (cols []string, vals []interface{}) {
+	if p.Title != nil {
+		cols, vals = append(cols, "title"), append(vals, *p.Title)
+	}
+	if p.Body != nil {
+		cols, vals = append(cols, "body"), append(vals, *p.Body)
+	}
+	if p.Tags != nil {
+		cols, vals = append(cols, "tags"), append(vals, *p.Tags)
+	}
+	if p.Sticky != nil {
+		cols, vals = append(cols, "sticky"), append(vals, *p.Sticky)
+	}
+	cols, vals = append(cols, "lastedited"), append(vals, lastedited)
+	return
+}
+
+// Patcher is implemented by Storage which can modify selected
+// fields of Note leaving the rest untouched.
+type Patcher interface {
+	// Patch modifies fields of Note with NoteID which are set in NotePatch.
+	// It should return NoteID if Note has been successfully modified.
+	Patch(NoteID, NotePatch) (NoteID, error)
+}
+
+// PatchNote modifies fields of Note with id which are set in p. If st
+// does not implement Patcher the note is fetched, patched and
+// written back with Upd.
+func PatchNote(st Storage, id NoteID, p NotePatch) (NoteID, error) {
+	if st == nil {
+		return BadNoteID, ErrStorageIsNil
+	}
+	if patcher, ok := st.(Patcher); ok {
+		return patcher.Patch(id, p)
+	}
+	notes, err := st.Get(id)
 	if err != nil {
-		return err
+		return BadNoteID, err
 	}
-	for i := len(sourcenotes) - 1; i >= 0; i-- {
-		if _, err := dst.Put(sourcenotes[i]); err != nil {
-			return err
-		}
+	if len(notes) == 0 {
+		return BadNoteID, ErrNoNotesFound
 	}
-	return nil
+	return st.Upd(id, p.Apply(notes[0]))
 }
 
 // ExportJSON requests all Notes from st Storage, serializes to
 // JSON and returns byte array. Just use string(output) if string type
-// is required.
+// is required. Use ExportJSONTo or ExportNDJSON to write large storages
+// out without keeping whole output in memory.
 func ExportJSON(st Storage) ([]byte, error) {
 	if st == nil {
 		return []byte{}, ErrStorageIsNil
 	}
-	notes, err := st.Get()
-	if err != nil {
-		return []byte{}, ErrStorageIsNil
+	var buf bytes.Buffer
+	if err := ExportJSONTo(&buf, st); err != nil {
+		return []byte{}, err
 	}
-	b := noteListToBytes(notes)
-	return b, nil
+	return buf.Bytes(), nil
 }
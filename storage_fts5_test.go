@@ -0,0 +1,8 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package notepet
+
+func init() {
+	requireFTS = true
+}
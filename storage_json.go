@@ -6,7 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -20,6 +20,18 @@ type JSONFileStorage struct {
 	idToIndex map[NoteID]int
 	filename  string
 	changed   bool
+	meta      jsonFileMeta
+}
+
+// jsonFileMeta holds data other than notes (history of notes etc.)
+// It is kept in a separate file next to the file with notes so that
+// format of the latter does not change.
+type jsonFileMeta struct {
+	History map[NoteID][]Revision `json:"history,omitempty"`
+	Trash   []DeletedNote         `json:"trash,omitempty"`
+	Changes map[NoteID]Change     `json:"changes,omitempty"`
+	Shares  map[NoteID][]Share    `json:"shares,omitempty"`
+	Seq     int64                 `json:"seq,omitempty"` // sequence number of the last change
 }
 
 // OpenOrInitJSONFileStorage returns Storage interface is file exists
@@ -46,7 +58,17 @@ func OpenJSONFileStorage(filename string) (*JSONFileStorage, error) {
 	if err = json.Unmarshal(data, &st.Notes); err != nil {
 		return nil, err
 	}
+	if err = st.readMeta(); err != nil {
+		return nil, err
+	}
+	for i := range st.Notes {
+		if tags := NormalizeTags(st.Notes[i].Tags); tags != st.Notes[i].Tags {
+			st.Notes[i].Tags = tags
+			st.changed = true
+		}
+	}
 	st.reindex()
+	st.seedChanges()
 	st.startSyncDaemon(time.Minute * 2)
 	return &st, nil
 }
@@ -103,15 +125,79 @@ func (st *JSONFileStorage) Put(note Note) (NoteID, error) {
 	t := time.Now()
 	note.TimeStamp = t
 	note.LastEdited = t
-	note.ID = generateID(note)
+	id, err := noteIDFor(note)
+	if err != nil {
+		return BadNoteID, err
+	}
+	note.ID = id
+	note.Tags = NormalizeTags(note.Tags)
 	st.mu.Lock()
 	defer st.mu.Unlock()
+	if st.idTaken(note.ID) {
+		return BadNoteID, ErrNoteExists
+	}
 	st.Notes = append(st.Notes, note)
+	st.recordChange(note.ID, false)
 	st.changed = true
 	defer st.reindex()
 	return note.ID, nil
 }
 
+// idTaken reports whether id is used by a note, note in trash or
+// history of one. Caller should hold st.mu.
+func (st *JSONFileStorage) idTaken(id NoteID) bool {
+	if _, ok := st.idToIndex[id]; ok {
+		return true
+	}
+	if _, ok := st.meta.History[id]; ok {
+		return true
+	}
+	for _, deleted := range st.meta.Trash {
+		if deleted.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Import implements Importer
+func (st *JSONFileStorage) Import(note Note) (ImportStatus, error) {
+	note, err := prepareImport(note)
+	if err != nil {
+		return ImportAdded, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if index, ok := st.idToIndex[note.ID]; ok {
+		return compareImported(st.Notes[index], note), nil
+	}
+	st.Notes = append(st.Notes, note)
+	st.recordChange(note.ID, false)
+	st.changed = true
+	st.reindex()
+	return ImportAdded, nil
+}
+
+// Replace implements Replacer
+func (st *JSONFileStorage) Replace(note Note) error {
+	note, err := prepareImport(note)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	index, ok := st.idToIndex[note.ID]
+	if !ok {
+		return ErrNoNotesFound
+	}
+	st.recordRevision(st.Notes[index])
+	st.Notes[index] = note
+	st.recordChange(note.ID, false)
+	st.changed = true
+	st.reindex()
+	return nil
+}
+
 // Upd replaces Note with id with supplied Note note.
 // Returns error if underlying io operation is unsucessful
 func (st *JSONFileStorage) Upd(id NoteID, note Note) (NoteID, error) {
@@ -119,6 +205,7 @@ func (st *JSONFileStorage) Upd(id NoteID, note Note) (NoteID, error) {
 		return BadNoteID, ErrCanNotAddEmptyNote
 	}
 	note.LastEdited = time.Now()
+	note.Tags = NormalizeTags(note.Tags)
 	st.mu.Lock()
 	defer st.mu.Unlock()
 	index, ok := st.idToIndex[id]
@@ -127,14 +214,39 @@ func (st *JSONFileStorage) Upd(id NoteID, note Note) (NoteID, error) {
 	}
 	note.ID = id // ID won't change when replacing, only note.TimeEdited
 	note.TimeStamp = st.Notes[index].TimeStamp
+	note.Owner = st.Notes[index].Owner
+	st.recordRevision(st.Notes[index])
 	st.Notes[index] = note
+	st.recordChange(note.ID, false)
 	st.changed = true
 	defer st.reindex()
 	return note.ID, nil
 
 }
 
-// Del removes Note from Storage
+// Patch modifies fields of Note with id set in patch p.
+func (st *JSONFileStorage) Patch(id NoteID, p NotePatch) (NoteID, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	index, ok := st.idToIndex[id]
+	if !ok {
+		return BadNoteID, ErrNoNotesFound
+	}
+	note := p.Apply(st.Notes[index])
+	if note.Title == "" && note.Body == "" {
+		return BadNoteID, ErrCanNotAddEmptyNote
+	}
+	note.Tags = NormalizeTags(note.Tags)
+	note.LastEdited = time.Now()
+	st.recordRevision(st.Notes[index])
+	st.Notes[index] = note
+	st.recordChange(note.ID, false)
+	st.changed = true
+	defer st.reindex()
+	return note.ID, nil
+}
+
+// Del moves Note from Storage to trash
 func (st *JSONFileStorage) Del(id NoteID) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
@@ -142,30 +254,222 @@ func (st *JSONFileStorage) Del(id NoteID) error {
 	if !ok {
 		return ErrNoNotesFound
 	}
+	deleted := DeletedNote{Note: st.Notes[index], Deleted: time.Now()}
+	st.meta.Trash = append([]DeletedNote{deleted}, st.meta.Trash...)
 	st.Notes = append(st.Notes[:index], st.Notes[index+1:]...)
+	st.recordChange(id, true)
 	st.changed = true
 	defer st.reindex()
 	return nil
 }
 
-//Search removes leading and trailing spaces from request and matches the resulting substring
-//against each note in the storage, checking body and title. Search is case insensitive.
-func (st *JSONFileStorage) Search(want string) ([]Note, error) {
-	want = strings.ToLower(strings.Trim(want, " \n"))
-	var result []Note
+// Trash returns notes in trash, most recently deleted first
+func (st *JSONFileStorage) Trash() ([]DeletedNote, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]DeletedNote{}, st.meta.Trash...), nil
+}
+
+// Undelete moves Note with id from trash back to Storage
+func (st *JSONFileStorage) Undelete(id NoteID) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.idToIndex[id]; ok {
+		return ErrNoteExists
+	}
+	for i, deleted := range st.meta.Trash {
+		if deleted.ID == id {
+			st.Notes = append(st.Notes, deleted.Note)
+			st.meta.Trash = append(st.meta.Trash[:i], st.meta.Trash[i+1:]...)
+			st.recordChange(id, false)
+			st.changed = true
+			st.reindex()
+			return nil
+		}
+	}
+	return ErrNoNotesFound
+}
+
+// EmptyTrash permanently removes notes deleted before t
+func (st *JSONFileStorage) EmptyTrash(t time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	kept := []DeletedNote{}
+	for _, deleted := range st.meta.Trash {
+		if deleted.Deleted.Before(t) {
+			delete(st.meta.History, deleted.ID)
+			delete(st.meta.Shares, deleted.ID)
+		} else {
+			kept = append(kept, deleted)
+		}
+	}
+	removed := len(st.meta.Trash) - len(kept)
+	if removed > 0 {
+		st.meta.Trash = kept
+		st.changed = true
+	}
+	return removed, nil
+}
+
+// History returns previous revisions of Note with id, oldest first
+func (st *JSONFileStorage) History(id NoteID) ([]Revision, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.idToIndex[id]; !ok {
+		return []Revision{}, ErrNoNotesFound
+	}
+	return append([]Revision{}, st.meta.History[id]...), nil
+}
+
+// Revision returns revision rev of Note with id
+func (st *JSONFileStorage) Revision(id NoteID, rev int) (Revision, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, r := range st.meta.History[id] {
+		if r.Rev == rev {
+			return r, nil
+		}
+	}
+	return Revision{}, ErrNoSuchRevision
+}
+
+// Shares returns shares of Note with id
+func (st *JSONFileStorage) Shares(id NoteID) ([]Share, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]Share{}, st.meta.Shares[id]...), nil
+}
+
+// SharedWith returns shares granted to any of grantees
+func (st *JSONFileStorage) SharedWith(grantees []string) ([]Share, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	want := make(map[string]struct{}, len(grantees))
+	for _, g := range grantees {
+		want[g] = struct{}{}
+	}
+	shares := []Share{}
+	for _, noteShares := range st.meta.Shares {
+		for _, s := range noteShares {
+			if _, ok := want[s.Grantee]; ok {
+				shares = append(shares, s)
+			}
+		}
+	}
+	return shares, nil
+}
+
+// Share grants access to note replacing earlier share to the same grantee
+func (st *JSONFileStorage) Share(s Share) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.idToIndex[s.ID]; !ok {
+		return ErrNoNotesFound
+	}
+	if st.meta.Shares == nil {
+		st.meta.Shares = make(map[NoteID][]Share)
+	}
+	shares := []Share{s}
+	for _, old := range st.meta.Shares[s.ID] {
+		if old.Grantee != s.Grantee {
+			shares = append(shares, old)
+		}
+	}
+	st.meta.Shares[s.ID] = shares
+	st.changed = true
+	return nil
+}
+
+// Unshare revokes access of grantee to Note with id
+func (st *JSONFileStorage) Unshare(id NoteID, grantee string) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	for i := 0; i < len(st.Notes); i++ {
-		if strings.Contains(strings.ToLower(st.Notes[i].String()), want) {
-			result = append(result, st.Notes[i])
+	shares := []Share{}
+	for _, s := range st.meta.Shares[id] {
+		if s.Grantee != grantee {
+			shares = append(shares, s)
 		}
 	}
+	if len(shares) == len(st.meta.Shares[id]) {
+		return ErrNoNotesFound
+	}
+	if len(shares) == 0 {
+		delete(st.meta.Shares, id)
+	} else {
+		st.meta.Shares[id] = shares
+	}
+	st.changed = true
+	return nil
+}
+
+// Tags returns all tags with number of notes marked with each
+func (st *JSONFileStorage) Tags() ([]TagCount, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return CountTags(st.Notes), nil
+}
+
+// GetByTags returns notes marked with all of tags or with any of them
+func (st *JSONFileStorage) GetByTags(tags []string, all bool) ([]Note, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return filterByTags(st.Notes, tags, all)
+}
+
+// Search parses query (see QueryNode) and matches it against each note
+// in the storage. Text is matched as case insensitive substring.
+func (st *JSONFileStorage) Search(query string) ([]Note, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return []Note{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	result := MatchQuery(st.Notes, q)
 	if len(result) == 0 {
 		return result, ErrNoNotesFound
 	}
 	return result, nil
 }
 
+// Changes implements ChangeStorage
+func (st *JSONFileStorage) Changes(since int64, limit int) ([]Change, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.changes(func(c Change) bool { return c.Seq > since }, limit), nil
+}
+
+// ChangesAfter implements ChangeTimeStorage
+func (st *JSONFileStorage) ChangesAfter(t time.Time, limit int) ([]Change, int64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.changes(func(c Change) bool { return c.Time.After(t) }, limit), st.meta.Seq, nil
+}
+
+// changes returns changes for which keep returns true ordered by
+// sequence number. Caller should hold st.mu.
+func (st *JSONFileStorage) changes(keep func(Change) bool, limit int) []Change {
+	changes := []Change{}
+	for _, c := range st.meta.Changes {
+		if !keep(c) {
+			continue
+		}
+		if index, ok := st.idToIndex[c.ID]; ok && !c.Deleted {
+			n := st.Notes[index]
+			c.Note = &n
+		}
+		changes = append(changes, c)
+	}
+	sortChanges(changes)
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes
+}
+
 // Close flushes all notes to disk
 func (st *JSONFileStorage) Close() (err error) {
 	st.mu.Lock()
@@ -189,11 +493,78 @@ func (st *JSONFileStorage) syncToDisk() error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(st.filename, data, 0664)
+	if err := ioutil.WriteFile(st.filename, data, 0664); err != nil {
+		return err
+	}
+	data, err = json.Marshal(st.meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(st.metaFilename(), data, 0664)
+}
+
+// readMeta reads file with history etc. It is not an error
+// if the file does not exist.
+func (st *JSONFileStorage) readMeta() error {
+	data, err := ioutil.ReadFile(st.metaFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &st.meta)
+}
+
+func (st *JSONFileStorage) metaFilename() string {
+	return st.filename + ".meta"
+}
+
+// recordRevision adds n to history. Caller should hold st.mu.
+func (st *JSONFileStorage) recordRevision(n Note) {
+	if st.meta.History == nil {
+		st.meta.History = make(map[NoteID][]Revision)
+	}
+	revs := st.meta.History[n.ID]
+	rev := 1
+	if len(revs) > 0 {
+		rev = revs[len(revs)-1].Rev + 1
+	}
+	st.meta.History[n.ID] = append(revs, newRevision(n, rev))
+}
+
+// seedChanges records changes of notes added by earlier versions
+// which did not keep changes, oldest first.
+func (st *JSONFileStorage) seedChanges() {
+	var unrecorded []Note
+	for _, n := range st.Notes {
+		if _, ok := st.meta.Changes[n.ID]; !ok {
+			unrecorded = append(unrecorded, n)
+		}
+	}
+	sort.Slice(unrecorded, func(i, j int) bool { return unrecorded[i].LastEdited.Before(unrecorded[j].LastEdited) })
+	if len(unrecorded) > 0 && st.meta.Changes == nil {
+		st.meta.Changes = make(map[NoteID]Change)
+	}
+	for _, n := range unrecorded {
+		st.meta.Seq++
+		st.meta.Changes[n.ID] = Change{Seq: st.meta.Seq, ID: n.ID, Time: n.LastEdited}
+		st.changed = true
+	}
+}
+
+// recordChange assigns the next sequence number to change
+// of note with id. Caller should hold st.mu.
+func (st *JSONFileStorage) recordChange(id NoteID, deleted bool) {
+	if st.meta.Changes == nil {
+		st.meta.Changes = make(map[NoteID]Change)
+	}
+	st.meta.Seq++
+	st.meta.Changes[id] = Change{Seq: st.meta.Seq, ID: id, Deleted: deleted, Time: time.Now()}
 }
 
 func (st *JSONFileStorage) reindex() {
 	sortNotes(st.Notes)
+	st.idToIndex = make(map[NoteID]int, len(st.Notes))
 	for index, note := range st.Notes {
 		st.idToIndex[note.ID] = index
 	}
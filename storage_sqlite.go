@@ -12,8 +12,52 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqliteSchema holds statements run each time database is opened.
+// They should be safe to run on existing database so that the
+// schema of databases created by earlier versions gets updated.
+var sqliteSchema = []string{
+	`create table if not exists history (id text, rev integer, title text, body text, tags text, sticky boolean, lastedited datetime, primary key (id, rev))`,
+	`create table if not exists trash (id text primary key unique, title text, body text, tags text, sticky boolean, timestamp datetime, lastedited datetime, deleted datetime)`,
+	`create table if not exists note_tags (id text, tag text, primary key (id, tag))`,
+	`create index if not exists note_tags_tag on note_tags (tag)`,
+	`create table if not exists shares (id text, grantee text, access text, primary key (id, grantee))`,
+	`create index if not exists shares_grantee on shares (grantee)`,
+	// changes holds the latest change of each note. Replacing row gives
+	// it the next sequence number as seq is autoincremented.
+	`create table if not exists changes (seq integer primary key autoincrement, id text unique, deleted boolean, changed datetime)`,
+	`insert into changes (id, deleted, changed) select id, 0, lastedited from notes where id not in (select id from changes) order by lastedited`,
+	`create trigger if not exists notes_changes_insert after insert on notes begin
+insert or replace into changes (id, deleted, changed) values (new.id, 0, new.lastedited);
+end`,
+	`create trigger if not exists notes_changes_update after update on notes begin
+insert or replace into changes (id, deleted, changed) values (new.id, 0, new.lastedited);
+end`,
+	`create trigger if not exists notes_changes_delete after delete on notes begin
+insert or replace into changes (id, deleted, changed) values (old.id, 1, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+end`,
+}
+
+// sqliteFTSSchema creates full text search index of notes kept up to
+// date by triggers. It requires SQLite built with FTS5 (sqlite_fts5 build
+// tag of go-sqlite3). If FTS5 is not available Search falls back to
+// matching substrings of notes.
+var sqliteFTSSchema = []string{
+	`create virtual table if not exists notes_fts using fts5(id unindexed, title, body, tags)`,
+	`create trigger if not exists notes_fts_insert after insert on notes begin
+insert into notes_fts (id, title, body, tags) values (new.id, new.title, new.body, new.tags);
+end`,
+	`create trigger if not exists notes_fts_delete after delete on notes begin
+delete from notes_fts where id = old.id;
+end`,
+	`create trigger if not exists notes_fts_update after update on notes begin
+delete from notes_fts where id = old.id;
+insert into notes_fts (id, title, body, tags) values (new.id, new.title, new.body, new.tags);
+end`,
+}
+
 type SQLiteStorage struct {
-	db *sql.DB
+	db  *sql.DB
+	fts bool // full text search index is available
 }
 
 func OpenOrInitSQLiteStorage(filename string) (Storage, error) {
@@ -56,40 +100,172 @@ func openSQLiteStorage(filename string, initDB bool) (Storage, error) {
 			return nil, err
 		}
 	}
+	for _, statement := range sqliteSchema {
+		if _, err := sqls.db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	if err := sqls.migrateOwner(); err != nil {
+		return nil, err
+	}
+	if err := sqls.migrateTags(); err != nil {
+		return nil, err
+	}
+	if err := sqls.initFTS(); err != nil {
+		log.Println("sqlite: full text search is not available (build with -tags sqlite_fts5), falling back to substring search:", err)
+	} else {
+		sqls.fts = true
+	}
 	db.SetMaxOpenConns(1)
 	return &sqls, nil
 }
 
+// initFTS creates full text search index and fills it with existing
+// notes if the index has just been created.
+func (sqls *SQLiteStorage) initFTS() error {
+	var exists int
+	if err := sqls.db.QueryRow(`select count(*) from sqlite_master where name = 'notes_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range sqliteFTSSchema {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	if exists == 0 {
+		if _, err := tx.Exec(`insert into notes_fts (id, title, body, tags) select id, title, body, tags from notes`); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateOwner adds owner column to tables of notes and trash. Notes
+// added by earlier versions have no owner.
+func (sqls *SQLiteStorage) migrateOwner() error {
+	for _, table := range []string{"notes", "trash"} {
+		var exists int
+		if err := sqls.db.QueryRow(`select count(*) from pragma_table_info(?) where name = 'owner'`, table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := sqls.db.Exec(`alter table ` + table + ` add column owner text not null default ''`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTags normalizes tags of notes added by earlier versions
+// which kept tags only as a string and fills note_tags table.
+func (sqls *SQLiteStorage) migrateTags() error {
+	rows, err := sqls.db.Query(`select id, tags from notes where tags != '' and id not in (select id from note_tags)`)
+	if err != nil {
+		return err
+	}
+	untagged := make(map[NoteID]string)
+	for rows.Next() {
+		var id NoteID
+		var tags string
+		if err := rows.Scan(&id, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		untagged[id] = tags
+	}
+	rows.Close()
+	if len(untagged) == 0 {
+		return nil
+	}
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, tags := range untagged {
+		tags = NormalizeTags(tags)
+		if _, err := tx.Exec(`update notes set tags = ? where id = ?`, tags, id); err != nil {
+			return err
+		}
+		if err := sqls.setTags(tx, id, tags); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (sqls *SQLiteStorage) Get(ids ...NoteID) ([]Note, error) {
-	var rows *sql.Rows
-	var err error
 	switch {
 	case len(ids) > 0:
-		statement := `select * from notes where id = ?`
-		rows, err = sqls.db.Query(statement, ids[0])
+		return sqls.queryNotes(`select * from notes where id = ?`, ids[0])
 	default:
-		statement := `select * from notes`
-		rows, err = sqls.db.Query(statement)
+		return sqls.queryNotes(`select * from notes`)
 	}
+}
+
+// queryNotes runs statement selecting all columns of notes table
+// and returns sorted notes.
+func (sqls *SQLiteStorage) queryNotes(statement string, args ...interface{}) ([]Note, error) {
+	notes, err := sqls.scanNotes(statement, args...)
+	sortNotes(notes)
+	return notes, err
+}
+
+// scanNotes runs statement selecting all columns of notes table
+// and returns notes in order they were selected.
+func (sqls *SQLiteStorage) scanNotes(statement string, args ...interface{}) ([]Note, error) {
 	notes := []Note{}
+	rows, err := sqls.db.Query(statement, args...)
 	if err != nil {
 		return notes, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var n Note
-		//var id string
-		if rows.Scan(&n.ID, &n.Title, &n.Body, &n.Tags, &n.Sticky, &n.TimeStamp, &n.LastEdited); err == nil {
-			//n.ID = NoteID(id)
+		if err := rows.Scan(&n.ID, &n.Title, &n.Body, &n.Tags, &n.Sticky, &n.TimeStamp, &n.LastEdited, &n.Owner); err == nil {
 			notes = append(notes, n)
 		} else {
 			log.Println(err)
 		}
 	}
-	sortNotes(notes)
 	return notes, nil
 }
 
+// sqliteOrders maps sort orders of ListOptions to order by clauses
+var sqliteOrders = map[string]string{
+	SortStickyFirst: "sticky desc, timestamp desc",
+	SortCreated:     "timestamp desc",
+	SortLastEdited:  "lastedited desc",
+	SortTitle:       "title collate nocase, timestamp desc",
+}
+
+// List implements Lister
+func (sqls *SQLiteStorage) List(opts ListOptions) (Page, error) {
+	if err := opts.normalize(); err != nil {
+		return Page{Notes: []Note{}}, err
+	}
+	where, args := listFilter(opts, sqliteDialect)
+	var total int
+	if err := sqls.db.QueryRow(`select count(*) from notes where `+where, args...).Scan(&total); err != nil {
+		return Page{Notes: []Note{}}, err
+	}
+	limit := -1 // sqlite does not allow offset without limit
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+	statement := fmt.Sprintf(`select * from notes where %s order by %s limit %d offset %d`,
+		where, sqliteOrders[opts.Sort], limit, opts.Offset)
+	notes, err := sqls.scanNotes(statement, args...)
+	return newPage(notes, total, opts), err
+}
+
 func (sqls *SQLiteStorage) Put(n Note) (NoteID, error) {
 	if n.Title == "" && n.Body == "" {
 		return BadNoteID, ErrCanNotAddEmptyNote
@@ -97,57 +273,564 @@ func (sqls *SQLiteStorage) Put(n Note) (NoteID, error) {
 	t := time.Now()
 	n.TimeStamp = t
 	n.LastEdited = t
-	n.ID = generateID(n)
-	statement := `insert into notes values (?, ?, ?, ?, ?, ?, ?)`
-	_, err := sqls.db.Exec(statement, n.ID, n.Title, n.Body, n.Tags, n.Sticky, n.TimeStamp, n.LastEdited)
+	id, err := noteIDFor(n)
 	if err != nil {
 		return BadNoteID, err
 	}
+	n.ID = id
+	n.Tags = NormalizeTags(n.Tags)
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return BadNoteID, err
+	}
+	defer tx.Rollback()
+	var exists int
+	statement := `select (select count(*) from notes where id = ?) + (select count(*) from trash where id = ?) + (select count(*) from history where id = ?)`
+	if err := tx.QueryRow(statement, n.ID, n.ID, n.ID).Scan(&exists); err != nil {
+		return BadNoteID, err
+	}
+	if exists > 0 {
+		return BadNoteID, ErrNoteExists
+	}
+	statement = `insert into notes values (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(statement, n.ID, n.Title, n.Body, n.Tags, n.Sticky, n.TimeStamp, n.LastEdited, n.Owner); err != nil {
+		return BadNoteID, err
+	}
+	if err := sqls.setTags(tx, n.ID, n.Tags); err != nil {
+		return BadNoteID, err
+	}
+	if err := tx.Commit(); err != nil {
+		return BadNoteID, err
+	}
 	return n.ID, nil
 }
 
+// Import implements Importer
+func (sqls *SQLiteStorage) Import(n Note) (ImportStatus, error) {
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return ImportAdded, err
+	}
+	defer tx.Rollback()
+	status, err := sqls.importNote(tx, n)
+	if err != nil || status != ImportAdded {
+		return status, err
+	}
+	return status, tx.Commit()
+}
+
+// Replace implements Replacer
+func (sqls *SQLiteStorage) Replace(n Note) error {
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := sqls.replaceNote(tx, n); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BeginImport implements TxImporter
+func (sqls *SQLiteStorage) BeginImport() (ImportTx, error) {
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteImportTx{sqls: sqls, tx: tx}, nil
+}
+
+type sqliteImportTx struct {
+	sqls *SQLiteStorage
+	tx   *sql.Tx
+}
+
+func (t *sqliteImportTx) Import(n Note) (ImportStatus, error) {
+	return t.sqls.importNote(t.tx, n)
+}
+
+func (t *sqliteImportTx) Replace(n Note) error {
+	return t.sqls.replaceNote(t.tx, n)
+}
+
+func (t *sqliteImportTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqliteImportTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (sqls *SQLiteStorage) importNote(tx *sql.Tx, n Note) (ImportStatus, error) {
+	n, err := prepareImport(n)
+	if err != nil {
+		return ImportAdded, err
+	}
+	var existing Note
+	err = tx.QueryRow(`select * from notes where id = ?`, n.ID).Scan(&existing.ID, &existing.Title, &existing.Body, &existing.Tags, &existing.Sticky, &existing.TimeStamp, &existing.LastEdited, &existing.Owner)
+	switch {
+	case err == nil:
+		return compareImported(existing, n), nil
+	case err != sql.ErrNoRows:
+		return ImportAdded, err
+	}
+	statement := `insert into notes values (?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := tx.Exec(statement, n.ID, n.Title, n.Body, n.Tags, n.Sticky, n.TimeStamp, n.LastEdited, n.Owner); err != nil {
+		return ImportAdded, err
+	}
+	return ImportAdded, sqls.setTags(tx, n.ID, n.Tags)
+}
+
+func (sqls *SQLiteStorage) replaceNote(tx *sql.Tx, n Note) error {
+	n, err := prepareImport(n)
+	if err != nil {
+		return err
+	}
+	if err := sqls.recordRevision(tx, n.ID); err != nil {
+		return err
+	}
+	statement := `update notes set title = ?, body = ?, tags = ?, sticky = ?, timestamp = ?, lastedited = ?, owner = ? where id = ?`
+	res, err := tx.Exec(statement, n.Title, n.Body, n.Tags, n.Sticky, n.TimeStamp, n.LastEdited, n.Owner, n.ID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return ErrNoNotesFound
+	}
+	return sqls.setTags(tx, n.ID, n.Tags)
+}
+
 func (sqls *SQLiteStorage) Upd(id NoteID, n Note) (NoteID, error) {
 	/* if _, err := sqls.Get(id); err != nil {
 		return BadNoteID, err
 	} */
 	n.LastEdited = time.Now()
+	n.Tags = NormalizeTags(n.Tags)
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return BadNoteID, err
+	}
+	defer tx.Rollback()
+	if err := sqls.recordRevision(tx, id); err != nil {
+		return BadNoteID, err
+	}
 	statement := `update notes set title = ?, body = ?, tags = ?, sticky = ?, lastedited = ? where id = ?`
-	_, err := sqls.db.Exec(statement, n.Title, n.Body, n.Tags, n.Sticky, n.LastEdited, id)
+	res, err := tx.Exec(statement, n.Title, n.Body, n.Tags, n.Sticky, n.LastEdited, id)
 	if err != nil {
-		id = BadNoteID
+		return BadNoteID, err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return BadNoteID, ErrNoNotesFound
+	}
+	if err := sqls.setTags(tx, id, n.Tags); err != nil {
+		return BadNoteID, err
 	}
-	return id, err
+	return id, tx.Commit()
+}
+
+func (sqls *SQLiteStorage) Patch(id NoteID, p NotePatch) (NoteID, error) {
+	if p.Tags != nil {
+		tags := NormalizeTags(*p.Tags)
+		p.Tags = &tags
+	}
+	cols, vals := p.columns(time.Now())
+	for i := range cols {
+		cols[i] += " = ?"
+	}
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return BadNoteID, err
+	}
+	defer tx.Rollback()
+	if err := sqls.recordRevision(tx, id); err != nil {
+		return BadNoteID, err
+	}
+	statement := `update notes set ` + strings.Join(cols, ", ") + ` where id = ?`
+	res, err := tx.Exec(statement, append(vals, id)...)
+	if err != nil {
+		return BadNoteID, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return BadNoteID, ErrNoNotesFound
+	}
+	var title, body string
+	if err := tx.QueryRow(`select title, body from notes where id = ?`, id).Scan(&title, &body); err != nil {
+		return BadNoteID, err
+	}
+	if title == "" && body == "" {
+		return BadNoteID, ErrCanNotAddEmptyNote
+	}
+	if p.Tags != nil {
+		if err := sqls.setTags(tx, id, *p.Tags); err != nil {
+			return BadNoteID, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (sqls *SQLiteStorage) History(id NoteID) ([]Revision, error) {
+	revs := []Revision{}
+	if _, err := sqls.Get(id); err != nil {
+		return revs, err
+	}
+	statement := `select id, rev, title, body, tags, sticky, lastedited from history where id = ? order by rev`
+	rows, err := sqls.db.Query(statement, id)
+	if err != nil {
+		return revs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Revision
+		if err := rows.Scan(&r.ID, &r.Rev, &r.Title, &r.Body, &r.Tags, &r.Sticky, &r.LastEdited); err != nil {
+			return revs, err
+		}
+		revs = append(revs, r)
+	}
+	return revs, rows.Err()
+}
+
+func (sqls *SQLiteStorage) Revision(id NoteID, rev int) (Revision, error) {
+	var r Revision
+	statement := `select id, rev, title, body, tags, sticky, lastedited from history where id = ? and rev = ?`
+	err := sqls.db.QueryRow(statement, id, rev).Scan(&r.ID, &r.Rev, &r.Title, &r.Body, &r.Tags, &r.Sticky, &r.LastEdited)
+	if err == sql.ErrNoRows {
+		err = ErrNoSuchRevision
+	}
+	return r, err
+}
+
+// recordRevision copies current version of note with id to history
+func (sqls *SQLiteStorage) recordRevision(tx *sql.Tx, id NoteID) error {
+	statement := `insert into history (id, rev, title, body, tags, sticky, lastedited)
+select id, (select coalesce(max(rev), 0) + 1 from history where id = ?), title, body, tags, sticky, lastedited
+from notes where id = ?`
+	_, err := tx.Exec(statement, id, id)
+	return err
 }
 
 func (sqls *SQLiteStorage) Del(id NoteID) error {
-	statement := `delete from notes where id = ?`
-	_, err := sqls.db.Exec(statement, id)
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statement := `insert into trash (id, title, body, tags, sticky, timestamp, lastedited, owner, deleted)
+select id, title, body, tags, sticky, timestamp, lastedited, owner, ? from notes where id = ?`
+	res, err := tx.Exec(statement, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoNotesFound
+	}
+	if _, err := tx.Exec(`delete from notes where id = ?`, id); err != nil {
+		return err
+	}
+	if err := sqls.setTags(tx, id, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sqls *SQLiteStorage) Trash() ([]DeletedNote, error) {
+	notes := []DeletedNote{}
+	statement := `select id, title, body, tags, sticky, timestamp, lastedited, owner, deleted from trash order by deleted desc`
+	rows, err := sqls.db.Query(statement)
+	if err != nil {
+		return notes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n DeletedNote
+		if err := rows.Scan(&n.ID, &n.Title, &n.Body, &n.Tags, &n.Sticky, &n.TimeStamp, &n.LastEdited, &n.Owner, &n.Deleted); err != nil {
+			return notes, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+func (sqls *SQLiteStorage) Undelete(id NoteID) error {
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists int
+	if err := tx.QueryRow(`select count(*) from notes where id = ?`, id).Scan(&exists); err != nil {
+		return err
+	} else if exists > 0 {
+		return ErrNoteExists
+	}
+	statement := `insert into notes (id, title, body, tags, sticky, timestamp, lastedited, owner)
+select id, title, body, tags, sticky, timestamp, lastedited, owner from trash where id = ?`
+	res, err := tx.Exec(statement, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoNotesFound
+	}
+	var tags string
+	if err := tx.QueryRow(`select tags from trash where id = ?`, id).Scan(&tags); err != nil {
+		return err
+	}
+	if err := sqls.setTags(tx, id, tags); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from trash where id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (sqls *SQLiteStorage) Tags() ([]TagCount, error) {
+	counts := []TagCount{}
+	rows, err := sqls.db.Query(`select tag, count(*) from note_tags group by tag order by tag`)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tc TagCount
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			return counts, err
+		}
+		counts = append(counts, tc)
+	}
+	return counts, rows.Err()
+}
+
+func (sqls *SQLiteStorage) GetByTags(tags []string, all bool) ([]Note, error) {
+	tags = ParseTags(strings.Join(tags, " "))
+	if len(tags) == 0 {
+		return []Note{}, ErrNoNotesFound
+	}
+	args := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		args[i] = tag
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tags)), ", ")
+	subquery := `select id from note_tags where tag in (` + placeholders + `)`
+	if all {
+		subquery += fmt.Sprintf(` group by id having count(*) = %d`, len(tags))
+	}
+	notes, err := sqls.queryNotes(`select * from notes where id in (`+subquery+`)`, args...)
+	if err == nil && len(notes) == 0 {
+		err = ErrNoNotesFound
+	}
+	return notes, err
+}
+
+// Shares implements ShareStorage
+func (sqls *SQLiteStorage) Shares(id NoteID) ([]Share, error) {
+	return scanShares(sqls.db.Query(`select id, grantee, access from shares where id = ? order by grantee`, id))
+}
+
+// SharedWith implements ShareStorage
+func (sqls *SQLiteStorage) SharedWith(grantees []string) ([]Share, error) {
+	if len(grantees) == 0 {
+		return []Share{}, nil
+	}
+	args := make([]interface{}, len(grantees))
+	for i, g := range grantees {
+		args[i] = g
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(grantees)), ", ")
+	return scanShares(sqls.db.Query(`select id, grantee, access from shares where grantee in (`+placeholders+`)`, args...))
+}
+
+// Share implements ShareStorage
+func (sqls *SQLiteStorage) Share(s Share) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	var exists int
+	if err := sqls.db.QueryRow(`select count(*) from notes where id = ?`, s.ID).Scan(&exists); err != nil {
+		return err
+	} else if exists == 0 {
+		return ErrNoNotesFound
+	}
+	_, err := sqls.db.Exec(`insert or replace into shares (id, grantee, access) values (?, ?, ?)`, s.ID, s.Grantee, s.Access)
 	return err
 }
 
+// Unshare implements ShareStorage
+func (sqls *SQLiteStorage) Unshare(id NoteID, grantee string) error {
+	res, err := sqls.db.Exec(`delete from shares where id = ? and grantee = ?`, id, grantee)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNoNotesFound
+	}
+	return nil
+}
+
+// setTags replaces tags of note with id in note_tags table
+func (sqls *SQLiteStorage) setTags(tx *sql.Tx, id NoteID, tags string) error {
+	if _, err := tx.Exec(`delete from note_tags where id = ?`, id); err != nil {
+		return err
+	}
+	for _, tag := range ParseTags(tags) {
+		if _, err := tx.Exec(`insert into note_tags (id, tag) values (?, ?)`, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sqls *SQLiteStorage) EmptyTrash(t time.Time) (int, error) {
+	tx, err := sqls.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`delete from history where id in (select id from trash where deleted < ?)`, t); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`delete from shares where id in (select id from trash where deleted < ?)`, t); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`delete from trash where deleted < ?`, t)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), tx.Commit()
+}
+
+// sqliteDialect is used to translate search queries. Note that like
+// in SQLite is case insensitive only for ASCII letters. Times are kept
+// as text with time zone offset so they are compared with julianday.
+var sqliteDialect = sqlDialect{
+	placeholder: func(int) string { return "?" },
+	like:        "like",
+	created:     "timestamp",
+	time:        func(expr string) string { return "julianday(" + expr + ")" },
+}
+
+// Search looks up notes matching query (see QueryNode). Plain queries
+// made of words and phrases use full text search index if it is available.
 func (sqls *SQLiteStorage) Search(query string) ([]Note, error) {
-	var result []Note
-	notes, err := sqls.Get()
+	q, err := ParseQuery(query)
 	if err != nil {
+		return []Note{}, err
+	}
+	if sqls.fts && isPlainQuery(q) && ftsQuery(q) != "" {
+		var result []Note
+		found, err := sqls.SearchRanked(query)
+		for _, r := range found {
+			result = append(result, r.Note)
+		}
 		return result, err
 	}
-	query = strings.ToLower(query)
-	for _, note := range notes {
-		if strings.Contains(strings.ToLower(note.String()), query) {
-			result = append(result, note)
+	where, args := queryToSQL(q, sqliteDialect)
+	notes, err := sqls.queryNotes(`select * from notes where `+where, args...)
+	if err == nil && len(notes) == 0 {
+		err = ErrNoNotesFound
+	}
+	return notes, err
+}
+
+// SearchRanked uses full text search index to look up notes. Results are
+// ordered by relevance and hold snippets of text with highlighted matches.
+// If index is not available or query has field filters or operators it
+// returns results of Search.
+func (sqls *SQLiteStorage) SearchRanked(query string) ([]SearchResult, error) {
+	results := []SearchResult{}
+	q, err := ParseQuery(query)
+	if err != nil {
+		return results, err
+	}
+	match := ""
+	if isPlainQuery(q) {
+		match = ftsQuery(q)
+	}
+	if !sqls.fts || match == "" {
+		notes, err := sqls.Search(query)
+		for _, n := range notes {
+			results = append(results, SearchResult{Note: n})
+		}
+		return results, err
+	}
+	statement := `select n.id, n.title, n.body, n.tags, n.sticky, n.timestamp, n.lastedited, n.owner,
+-bm25(notes_fts, 0, 10.0, 1.0, 5.0), snippet(notes_fts, -1, ?, ?, '...', 16)
+from notes_fts join notes n on n.id = notes_fts.id
+where notes_fts match ? order by bm25(notes_fts, 0, 10.0, 1.0, 5.0)`
+	rows, err := sqls.db.Query(statement, SnippetMarkStart, SnippetMarkEnd, match)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r SearchResult
+		if err := rows.Scan(&r.ID, &r.Title, &r.Body, &r.Tags, &r.Sticky, &r.TimeStamp, &r.LastEdited, &r.Owner, &r.Rank, &r.Snippet); err != nil {
+			return results, err
 		}
+		results = append(results, r)
 	}
-	if len(result) == 0 {
-		return result, ErrNoNotesFound
+	if err := rows.Err(); err != nil {
+		return results, err
 	}
-	sortNotes(result)
-	return result, nil
+	if len(results) == 0 {
+		return results, ErrNoNotesFound
+	}
+	return results, nil
+}
+
+// Changes implements ChangeStorage
+func (sqls *SQLiteStorage) Changes(since int64, limit int) ([]Change, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	statement := `select c.seq, c.id, c.deleted, c.changed, n.title, n.body, n.tags, n.sticky, n.timestamp, n.lastedited, n.owner
+from changes c left join notes n on n.id = c.id where c.seq > ? order by c.seq limit ?`
+	rows, err := sqls.db.Query(statement, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanChanges(rows)
+}
+
+// ChangesAfter implements ChangeTimeStorage. Times of changes are
+// compared with julianday as deletions are recorded by SQLite in UTC
+// while other changes keep LastEdited of notes with time zone.
+func (sqls *SQLiteStorage) ChangesAfter(t time.Time, limit int) ([]Change, int64, error) {
+	var last int64
+	if err := sqls.db.QueryRow(`select coalesce(max(seq), 0) from changes`).Scan(&last); err != nil {
+		return nil, 0, err
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	statement := `select c.seq, c.id, c.deleted, c.changed, n.title, n.body, n.tags, n.sticky, n.timestamp, n.lastedited, n.owner
+from changes c left join notes n on n.id = c.id where julianday(c.changed) > julianday(?) order by c.seq limit ?`
+	rows, err := sqls.db.Query(statement, t, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	changes, err := scanChanges(rows)
+	return changes, last, err
 }
 
 func (sqls *SQLiteStorage) Close() error {
 	return sqls.db.Close()
 }
 
+// ExportJSON returns all notes in JSON format
 func (sqls *SQLiteStorage) ExportJSON() ([]byte, error) {
-	return []byte{}, nil
+	return ExportJSON(sqls)
+}
+
+// StreamNotes implements NoteStreamer. Notes are read in batches of
+// streamBatchSize and fn is called after each batch is read so that
+// connection to database is not held while fn runs.
+func (sqls *SQLiteStorage) StreamNotes(fn func(Note) error) error {
+	statement := fmt.Sprintf(`select * from notes order by %s, id limit %d offset ?`,
+		sqliteOrders[SortStickyFirst], streamBatchSize)
+	return streamBatches(func(offset int) ([]Note, error) {
+		return sqls.scanNotes(statement, offset)
+	}, fn)
 }
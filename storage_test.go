@@ -1,10 +1,13 @@
 package notepet
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var TestNotes = []byte(`
@@ -62,6 +65,14 @@ func testStorage(t *testing.T, st Storage) {
 			ids = append(ids, id)
 		}
 	}
+	if len(ids) > 0 && ids[0] != notes[0].ID {
+		fmt.Println("storage should keep ID of note put into it:", ids[0])
+		t.Fail()
+	}
+	if _, err := st.Put(notes[0]); err != ErrNoteExists {
+		fmt.Println("storage should not put note with existing ID:", err)
+		t.Fail()
+	}
 	received, err := st.Get()
 	if err != nil {
 		fmt.Println("storage failed to get all notes:", err)
@@ -101,6 +112,76 @@ func testStorage(t *testing.T, st Storage) {
 			t.Fail()
 		}
 	}
+	structured := map[string]int{
+		"title:test1 OR tag:tst2":              2,
+		"body:body -tag:tst4":                  3,
+		"(test1 OR test2) created:>2000-01-01": 2,
+		`"body3"`:                              1,
+		"tag:tst3 sticky:false":                1,
+	}
+	for q, want := range structured {
+		if res, err := st.Search(q); err != nil || len(res) != want {
+			fmt.Println("wrong result of query:", q, len(res), err)
+			t.Fail()
+		}
+	}
+	page, err := List(st, ListOptions{Sort: SortTitle, Limit: 3})
+	if err != nil || page.Total != 4 || len(page.Notes) != 3 || page.Notes[0].Title != "Test1" || page.Next == "" {
+		fmt.Println("wrong first page of notes sorted by title:", page, err)
+		t.Fail()
+	}
+	page, err = List(st, ListOptions{Sort: SortTitle, Limit: 3, Cursor: page.Next})
+	if err != nil || len(page.Notes) != 1 || page.Notes[0].Title != "Test4" || page.Next != "" {
+		fmt.Println("wrong last page of notes sorted by title:", page, err)
+		t.Fail()
+	}
+	if page, err = List(st, ListOptions{Offset: 1, Limit: 1, Tags: []string{"tst2", "tst3"}}); err != nil || page.Total != 2 || len(page.Notes) != 1 {
+		fmt.Println("wrong page of tagged notes:", page, err)
+		t.Fail()
+	}
+	var ndjson bytes.Buffer
+	streamed := 0
+	if err := ExportNDJSON(&ndjson, st); err != nil || strings.Count(ndjson.String(), "\n") != 4 {
+		fmt.Println("ExportNDJSON should write a line per note:", ndjson.String(), err)
+		t.Fail()
+	}
+	if err := DecodeNotes(&ndjson, func(Note) error { streamed++; return nil }); err != nil || streamed != 4 {
+		fmt.Println("DecodeNotes failed to read NDJSON:", streamed, err)
+		t.Fail()
+	}
+	if data, err := ExportJSON(st); err != nil {
+		fmt.Println("ExportJSON failed:", err)
+		t.Fail()
+	} else if exported, err := bytesToNoteList(data); err != nil || len(exported) != 4 {
+		fmt.Println("ExportJSON returned wrong notes:", len(exported), err)
+		t.Fail()
+	}
+	if _, err := st.Search("created:<2000-01-01"); err != ErrNoNotesFound {
+		fmt.Println("query matching nothing should return ErrNoNotesFound:", err)
+		t.Fail()
+	}
+	if tagged, err := GetByTags(st, []string{"tst"}, true); err != nil || len(tagged) != 1 || tagged[0].Title != "Test1" {
+		fmt.Println("tag lookup should match exact tags only:", tagged, err)
+		t.Fail()
+	}
+	if tagged, err := GetByTags(st, []string{"tst2", "tst3"}, false); err != nil || len(tagged) != 2 {
+		fmt.Println("tag lookup with any of tags failed:", tagged, err)
+		t.Fail()
+	}
+	if tagged, err := GetByTags(st, []string{}, true); err != ErrNoNotesFound || len(tagged) != 0 {
+		fmt.Println("tag lookup with no tags should find nothing:", tagged, err)
+		t.Fail()
+	}
+	if ts, ok := st.(TagStorage); ok {
+		if tagged, err := ts.GetByTags(nil, true); err != ErrNoNotesFound || len(tagged) != 0 {
+			fmt.Println("storage tag lookup with no tags should find nothing:", tagged, err)
+			t.Fail()
+		}
+		if counts, err := ts.Tags(); err != nil || len(counts) != 4 || counts[0] != (TagCount{Tag: "tst", Count: 1}) {
+			fmt.Println("unexpected tag counts:", counts, err)
+			t.Fail()
+		}
+	}
 	updID, err := st.Upd(received[0].ID, received[1])
 	if err != nil {
 		fmt.Println("failed to update existing note with err:", err)
@@ -117,7 +198,143 @@ func testStorage(t *testing.T, st Storage) {
 		fmt.Println("expected:", received[1])
 		t.Fail()
 	}
+	if hs, ok := st.(HistoryStorage); ok {
+		revs, err := hs.History(updID)
+		if err != nil || len(revs) != 1 || revs[0].Title != received[0].Title || revs[0].Body != received[0].Body {
+			fmt.Println("history does not hold previous version of updated note:", revs, err)
+			t.Fail()
+		}
+		if _, err := RestoreRevision(st, updID, 1); err != nil {
+			fmt.Println("failed to restore revision:", err)
+			t.Fail()
+		}
+		restored, _ := st.Get(updID)
+		if len(restored) == 0 || restored[0].Title != received[0].Title || restored[0].Body != received[0].Body {
+			fmt.Println("restored note differs from revision")
+			t.Fail()
+		}
+		if revs, _ := hs.History(updID); len(revs) != 2 {
+			fmt.Println("restoring revision should record current version in history")
+			t.Fail()
+		}
+	}
+	beforePatch, _ := st.Get(updID)
+	sticky, newTitle := true, "Patched"
+	if _, err := PatchNote(st, updID, NotePatch{Sticky: &sticky, Title: &newTitle}); err != nil {
+		fmt.Println("failed to patch existing note with err:", err)
+		t.Fail()
+	}
+	if patched, err := st.Get(updID); err != nil || !patched[0].Sticky || patched[0].Title != newTitle || patched[0].Body != beforePatch[0].Body {
+		fmt.Println("patched note has unexpected fields:", patched, err)
+		t.Fail()
+	}
+	empty := ""
+	if _, err := PatchNote(st, updID, NotePatch{Title: &empty, Body: &empty}); err != ErrCanNotAddEmptyNote {
+		fmt.Println("patch blanking title and body is accepted:", err)
+		t.Fail()
+	}
+	alice, bob := ForUser(st, User{Name: "alice", Role: RoleUser}), ForUser(st, User{Name: "bob", Role: RoleUser})
+	ownedID, err := alice.Put(Note{Title: "Owned", Body: "by alice"})
+	if owned, _ := alice.Get(); err != nil || len(owned) != 1 || owned[0].Owner != "alice" {
+		fmt.Println("user does not see own note:", owned, err)
+		t.Fail()
+	}
+	if _, err := bob.Get(ownedID); err != ErrNoNotesFound {
+		fmt.Println("user sees note of other user:", err)
+		t.Fail()
+	}
+	if err := bob.Del(ownedID); err == nil {
+		fmt.Println("user deleted note of other user")
+		t.Fail()
+	}
+	if _, err := alice.Upd(ownedID, Note{Title: "Owned", Body: "still by alice"}); err != nil {
+		fmt.Println("user failed to update own note:", err)
+		t.Fail()
+	}
+	if owned, err := st.Get(ownedID); err != nil || owned[0].Owner != "alice" {
+		fmt.Println("update has changed owner of note:", owned, err)
+		t.Fail()
+	}
+	if _, ok := st.(ShareStorage); ok {
+		carol := ForUser(st, User{Name: "carol", Role: RoleUser, Groups: []string{"ops"}})
+		if err := bob.(ShareStorage).Share(Share{ID: ownedID, Grantee: "bob", Access: AccessRead}); err == nil {
+			fmt.Println("user shared note of other user")
+			t.Fail()
+		}
+		if err := alice.(ShareStorage).Share(Share{ID: ownedID, Grantee: "bob", Access: AccessRead}); err != nil {
+			fmt.Println("user failed to share own note:", err)
+			t.Fail()
+		}
+		if shared, err := bob.Get(ownedID); err != nil || len(shared) != 1 {
+			fmt.Println("user does not see note shared with them:", shared, err)
+			t.Fail()
+		}
+		if _, err := bob.Upd(ownedID, Note{Title: "Owned", Body: "by bob"}); err != ErrPermissionDenied {
+			fmt.Println("user updated note shared read only:", err)
+			t.Fail()
+		}
+		alice.(ShareStorage).Share(Share{ID: ownedID, Grantee: "bob", Access: AccessReadWrite})
+		if _, err := bob.Upd(ownedID, Note{Title: "Owned", Body: "edited by bob"}); err != nil {
+			fmt.Println("user failed to update note shared read-write:", err)
+			t.Fail()
+		}
+		if err := bob.Del(ownedID); err != ErrPermissionDenied {
+			fmt.Println("user deleted note shared with them:", err)
+			t.Fail()
+		}
+		if _, err := carol.Get(ownedID); err != ErrNoNotesFound {
+			fmt.Println("user sees note not shared with them:", err)
+			t.Fail()
+		}
+		alice.(ShareStorage).Share(Share{ID: ownedID, Grantee: GroupPrefix + "ops", Access: AccessRead})
+		if shared, err := carol.Get(ownedID); err != nil || len(shared) != 1 {
+			fmt.Println("user does not see note shared with their group:", shared, err)
+			t.Fail()
+		}
+		if shares, err := alice.(ShareStorage).Shares(ownedID); err != nil || len(shares) != 2 {
+			fmt.Println("storage failed to list shares of note:", shares, err)
+			t.Fail()
+		}
+		if err := alice.(ShareStorage).Unshare(ownedID, "bob"); err != nil {
+			fmt.Println("user failed to unshare own note:", err)
+			t.Fail()
+		}
+		if _, err := bob.Get(ownedID); err != ErrNoNotesFound {
+			fmt.Println("user sees note after it has been unshared:", err)
+			t.Fail()
+		}
+		if err := alice.(ShareStorage).Unshare(ownedID, "bob"); err != ErrNoNotesFound {
+			fmt.Println("unsharing note twice does not report not found:", err)
+			t.Fail()
+		}
+	}
+	if _, ok := st.(HistoryStorage); ok {
+		deletedID, _ := alice.Put(Note{Title: "Deleted", Body: "by alice"})
+		alice.Upd(deletedID, Note{Title: "Deleted", Body: "secret of alice"})
+		alice.Del(deletedID)
+		if _, err := bob.Put(Note{ID: deletedID, Title: "Reused", Body: "by bob"}); err != ErrNoteExists {
+			fmt.Println("user put note with ID of deleted note of other user:", err)
+			t.Fail()
+		}
+		if revs, err := bob.(HistoryStorage).History(deletedID); err == nil || len(revs) != 0 {
+			fmt.Println("user sees history of deleted note of other user:", revs, err)
+			t.Fail()
+		}
+		alice.(TrashStorage).Undelete(deletedID)
+	}
+	before, err := Changes(st, 0, 0)
+	if err != nil || len(before.Changes) == 0 || before.Changes[len(before.Changes)-1].Note == nil {
+		fmt.Println("storage failed to report changes:", before, err)
+		t.Fail()
+	}
+	if first, err := Changes(st, 0, 1); err != nil || len(first.Changes) != 1 || !first.More || first.Last != first.Changes[0].Seq {
+		fmt.Println("limited feed of changes is wrong:", first, err)
+		t.Fail()
+	}
 	toDelete, _ := st.Get()
+	beforeDeletion := time.Now()
+	// times of changes kept by SQLite have millisecond precision
+	time.Sleep(10 * time.Millisecond)
 	var deleteErr error
 	for _, n := range toDelete {
 		if err := st.Del(n.ID); err != nil {
@@ -128,6 +345,48 @@ func testStorage(t *testing.T, st Storage) {
 		fmt.Println("storage failed to delete one or more existing notes")
 		t.Fail()
 	}
+	deletions, err := Changes(st, before.Last, 0)
+	if err != nil || len(deletions.Changes) != len(toDelete) || !deletions.Changes[0].Deleted || deletions.Changes[0].Note != nil {
+		fmt.Println("deleted notes are not reported as changes:", deletions, err)
+		t.Fail()
+	}
+	if since, err := ChangesSince(st, beforeDeletion, 0); err != nil || len(since.Changes) != len(toDelete) || since.Last != deletions.Last {
+		fmt.Println("changes made after time are wrong:", since, err)
+		t.Fail()
+	}
+	if since, err := ChangesSince(st, beforeDeletion, 1); err != nil || len(since.Changes) != 1 || !since.More {
+		fmt.Println("limited changes made after time are wrong:", since, err)
+		t.Fail()
+	}
+	if since, err := ChangesSince(st, time.Now().Add(time.Hour), 0); err != nil || len(since.Changes) != 0 || since.Last != deletions.Last {
+		fmt.Println("changes made after future time are wrong:", since, err)
+		t.Fail()
+	}
+	if ts, ok := st.(TrashStorage); ok {
+		trash, err := ts.Trash()
+		if err != nil || len(trash) != len(toDelete) {
+			fmt.Println("deleted notes are not in trash:", err)
+			t.Fail()
+		}
+		if _, err := st.Put(Note{ID: toDelete[1].ID, Title: "Reused ID"}); err != ErrNoteExists {
+			fmt.Println("note is put with ID of note in trash:", err)
+			t.Fail()
+		}
+		if err := ts.Undelete(toDelete[0].ID); err != nil {
+			fmt.Println("failed to undelete note:", err)
+			t.Fail()
+		}
+		if n, err := st.Get(toDelete[0].ID); err != nil || len(n) != 1 || n[0].Body != toDelete[0].Body {
+			fmt.Println("undeleted note differs from original")
+			t.Fail()
+		}
+		if n, err := ts.EmptyTrash(time.Now()); err != nil || n != len(toDelete)-1 {
+			fmt.Println("failed to empty trash:", n, err)
+			t.Fail()
+		}
+		st.Del(toDelete[0].ID)
+		ts.EmptyTrash(time.Now())
+	}
 }
 
 func Test_JSONStoragePutsAndGetsSameBack(t *testing.T) {
@@ -143,6 +402,7 @@ func Test_JSONStoragePutsAndGetsSameBack(t *testing.T) {
 		t.FailNow()
 	}
 	defer os.Remove(testfile)
+	defer os.Remove(testfile + ".meta")
 	defer st.Close()
 	testStorage(t, st)
 }
@@ -167,6 +427,283 @@ func Test_SQLiteStorage(t *testing.T) {
 	testStorage(t, st)
 }
 
+func Test_SQLiteStreamNotes(t *testing.T) {
+	testDBfile := "./test_stream.db"
+	os.Remove(testDBfile)
+	st, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		fmt.Println("could not create test_stream.db:", err)
+		t.FailNow()
+	}
+	defer os.Remove(testDBfile)
+	defer st.Close()
+	total := 2*streamBatchSize + 5
+	for i := 0; i < total; i++ {
+		if _, err := st.Put(Note{Title: fmt.Sprint("Note ", i), Body: "Body"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := make(map[NoteID]bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- StreamNotes(st, func(n Note) error {
+			// storage allows single connection so this blocks
+			// if StreamNotes holds it while calling fn
+			if _, err := st.Get(n.ID); err != nil {
+				return err
+			}
+			seen[n.ID] = true
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil || len(seen) != total {
+			fmt.Println("StreamNotes passed wrong notes:", len(seen), err)
+			t.Fail()
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StreamNotes holds connection to database while calling fn")
+	}
+}
+
+func Test_MigrateIDs(t *testing.T) {
+	src, _ := initFakeStorage()
+	for _, regenerate := range []bool{false, true} {
+		testDBfile := "./test_migrate.db"
+		os.Remove(testDBfile)
+		dst, err := OpenOrInitSQLiteStorage(testDBfile)
+		if err != nil {
+			fmt.Println("could not create test_migrate.db:", err)
+			t.FailNow()
+		}
+		report, err := MigrateWithOptions(dst, src, MigrateOptions{RegenerateIDs: regenerate})
+		if err != nil || len(report.Added) != len(src.Notes) {
+			fmt.Println("migration failed:", err, report)
+			t.Fail()
+		}
+		found, _ := dst.Get(src.Notes[0].ID)
+		if (len(found) == 1) == regenerate {
+			fmt.Println("wrong IDs after migration with RegenerateIDs =", regenerate)
+			t.Fail()
+		}
+		if !regenerate {
+			if len(found) != 1 || !found[0].TimeStamp.Equal(src.Notes[0].TimeStamp) || !found[0].LastEdited.Equal(src.Notes[0].LastEdited) {
+				fmt.Println("times of note not preserved by migration:", found)
+				t.Fail()
+			}
+			report, err = MigrateWithOptions(dst, src, MigrateOptions{})
+			if err != nil || len(report.Duplicates) != len(src.Notes) || len(report.Added) != 0 {
+				fmt.Println("second migration should only find duplicates:", err, report)
+				t.Fail()
+			}
+		}
+		dst.Close()
+		os.Remove(testDBfile)
+	}
+}
+
+func Test_MigrateSync(t *testing.T) {
+	src, _ := initFakeStorage()
+	testDBfile := "./test_sync.db"
+	os.Remove(testDBfile)
+	dst, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		fmt.Println("could not create test_sync.db:", err)
+		t.FailNow()
+	}
+	defer os.Remove(testDBfile)
+	defer dst.Close()
+	if _, err := MigrateWithOptions(dst, src, MigrateOptions{Transaction: true}); err != nil {
+		fmt.Println("migration failed:", err)
+		t.Fail()
+	}
+	src.Notes[0].Body = "edited after migration"
+	src.Notes[0].LastEdited = src.Notes[0].LastEdited.Add(time.Hour)
+	report, err := MigrateWithOptions(dst, src, MigrateOptions{Sync: true, DryRun: true})
+	if err != nil || len(report.Updated) != 1 || len(report.Duplicates) != len(src.Notes)-1 {
+		fmt.Println("dry run should report one updated note:", err, report)
+		t.Fail()
+	}
+	if found, _ := dst.Get(src.Notes[0].ID); len(found) != 1 || found[0].Body == src.Notes[0].Body {
+		fmt.Println("dry run has changed destination:", found)
+		t.Fail()
+	}
+	report, _ = MigrateWithOptions(dst, src, MigrateOptions{})
+	if len(report.Conflicts) != 1 {
+		fmt.Println("changed note should be a conflict without sync:", report)
+		t.Fail()
+	}
+	done := 0
+	report, err = MigrateWithOptions(dst, src, MigrateOptions{Sync: true, Progress: func(MigrateProgress) { done++ }})
+	if err != nil || len(report.Updated) != 1 || done != len(src.Notes) {
+		fmt.Println("sync failed:", err, report, done)
+		t.Fail()
+	}
+	if found, _ := dst.Get(src.Notes[0].ID); len(found) != 1 || found[0].Body != src.Notes[0].Body || !found[0].LastEdited.Equal(src.Notes[0].LastEdited) {
+		fmt.Println("note has not been replaced verbatim:", found)
+		t.Fail()
+	}
+	if history, _ := dst.(HistoryStorage).History(src.Notes[0].ID); len(history) != 1 {
+		fmt.Println("replaced version should be kept in history:", history)
+		t.Fail()
+	}
+}
+
+func Test_ReplicaSync(t *testing.T) {
+	src, _ := initFakeStorage()
+	remoteFile, localFile := "./test_remote.db", "./test_local.db"
+	for _, f := range []string{remoteFile, localFile, localFile + ".sync"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	remote, err := OpenOrInitSQLiteStorage(remoteFile)
+	if err != nil {
+		fmt.Println("could not create test_remote.db:", err)
+		t.FailNow()
+	}
+	defer remote.Close()
+	if err := Migrate(remote, src); err != nil {
+		fmt.Println("migration failed:", err)
+		t.FailNow()
+	}
+	replica, err := OpenSQLiteReplica(localFile, remote)
+	if err != nil {
+		fmt.Println("could not open replica:", err)
+		t.FailNow()
+	}
+	defer replica.Close()
+	if report, err := replica.Sync(); err != nil || len(report.Pulled) != len(src.Notes) {
+		fmt.Println("first sync should pull all notes:", err, report)
+		t.Fail()
+	}
+	notes := src.Notes
+	edited, removed, deleted, conflicting := notes[0], notes[1], notes[2], notes[3]
+	edited.Body = "edited offline"
+	replica.Upd(edited.ID, edited)
+	remote.Del(removed.ID)
+	replica.Del(deleted.ID)
+	added, _ := replica.Put(Note{Title: "offline", Body: "added offline"})
+	conflicting.Body = "edited offline"
+	replica.Upd(conflicting.ID, conflicting)
+	conflicting.Body = "edited on server"
+	remote.Upd(conflicting.ID, conflicting)
+	report, err := replica.Sync()
+	if err != nil || len(report.Pushed) != 2 || len(report.DeletedLocal) != 1 || len(report.DeletedRemote) != 1 || len(report.Conflicts) != 1 {
+		fmt.Println("unexpected sync report:", err, report)
+		t.Fail()
+	}
+	if found, _ := remote.Get(added); len(found) != 1 {
+		fmt.Println("note added offline not pushed")
+		t.Fail()
+	}
+	if found, _ := remote.Get(edited.ID); len(found) != 1 || found[0].Body != edited.Body {
+		fmt.Println("note edited offline not pushed:", found)
+		t.Fail()
+	}
+	if found, _ := replica.Get(conflicting.ID); len(found) != 1 || found[0].Body != "edited on server" {
+		fmt.Println("remote version of conflicting note should win:", found)
+		t.Fail()
+	}
+	localNotes, _ := replica.Get()
+	remoteNotes, _ := remote.Get()
+	if len(localNotes) != len(remoteNotes) || len(localNotes) != len(notes) {
+		fmt.Println("local and remote notes differ after sync:", len(localNotes), len(remoteNotes))
+		t.Fail()
+	}
+	if report, err := replica.Sync(); err != nil || len(report.Pulled)+len(report.Pushed)+len(report.Conflicts) != 0 {
+		fmt.Println("second sync should do nothing:", err, report)
+		t.Fail()
+	}
+}
+
+// renamingStorage gives new IDs to all notes added to it
+type renamingStorage struct {
+	Storage
+}
+
+func (s renamingStorage) Put(n Note) (NoteID, error) {
+	n.ID = ""
+	return s.Storage.Put(n)
+}
+
+func Test_ReplicaSyncNewID(t *testing.T) {
+	remoteFile, localFile := "./test_remote_ids.db", "./test_local_ids.db"
+	for _, f := range []string{remoteFile, localFile, localFile + ".sync"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+	remote, err := OpenOrInitSQLiteStorage(remoteFile)
+	if err != nil {
+		fmt.Println("could not create test_remote_ids.db:", err)
+		t.FailNow()
+	}
+	defer remote.Close()
+	replica, err := OpenSQLiteReplica(localFile, renamingStorage{remote})
+	if err != nil {
+		fmt.Println("could not open replica:", err)
+		t.FailNow()
+	}
+	defer replica.Close()
+	id, _ := replica.Put(Note{Title: "offline", Body: "added offline"})
+	if report, err := replica.Sync(); err != nil || len(report.Pushed) != 1 {
+		fmt.Println("note added offline is not pushed:", err, report)
+		t.Fail()
+	}
+	if report, err := replica.Sync(); err != nil || len(report.Pulled)+len(report.Pushed)+len(report.Conflicts) != 0 {
+		fmt.Println("second sync should do nothing:", err, report)
+		t.Fail()
+	}
+	local, _ := replica.Get()
+	pushed, _ := remote.Get()
+	if len(local) != 1 || len(pushed) != 1 || local[0].ID != pushed[0].ID || local[0].ID == id {
+		fmt.Println("local note should be moved to ID given by remote:", local, pushed)
+		t.Fail()
+	}
+}
+
+// Test_PostgresChangesAfter needs database given by NOTEPET_TEST_POSTGRES_DSN
+// environment variable and is skipped if it is not set.
+func Test_PostgresChangesAfter(t *testing.T) {
+	dsn := os.Getenv("NOTEPET_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("NOTEPET_TEST_POSTGRES_DSN is not set")
+	}
+	st, err := OpenPostgresStorageDSN(dsn)
+	if err != nil {
+		fmt.Println("could not connect to database:", err)
+		t.FailNow()
+	}
+	defer st.Close()
+	id, err := st.Put(Note{Title: "deleted note"})
+	if err != nil {
+		fmt.Println("could not put note:", err)
+		t.FailNow()
+	}
+	before := time.Now().Add(-time.Second)
+	if err := st.Del(id); err != nil {
+		fmt.Println("could not delete note:", err)
+		t.FailNow()
+	}
+	after := time.Now().Add(time.Second)
+	found := func(changes []Change) bool {
+		for _, c := range changes {
+			if c.ID == id && c.Deleted {
+				return true
+			}
+		}
+		return false
+	}
+	if changes, _, err := st.(ChangeTimeStorage).ChangesAfter(before.UTC(), 0); err != nil || !found(changes) {
+		fmt.Println("deletion is missing from changes:", changes, err)
+		t.Fail()
+	}
+	if changes, _, err := st.(ChangeTimeStorage).ChangesAfter(after.UTC(), 0); err != nil || found(changes) {
+		fmt.Println("deletion is reported as later change:", changes, err)
+		t.Fail()
+	}
+}
+
 func Test_PostgresStorage(t *testing.T) {
 	fmt.Println("Testing Postgres Storage")
 	st, err := OpenPostgresStorage("127.0.0.1", "5432", "notepet", "notepet", "notepet")
@@ -178,6 +715,90 @@ func Test_PostgresStorage(t *testing.T) {
 	testStorage(t, st)
 }
 
+func Test_SQLiteSearchTimeZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database is not available:", err)
+	}
+	local := time.Local
+	time.Local = newYork
+	defer func() { time.Local = local }()
+	testDBfile := "./test_tz.db"
+	os.Remove(testDBfile)
+	st, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		fmt.Println("could not create test_tz.db:", err)
+		t.FailNow()
+	}
+	defer os.Remove(testDBfile)
+	defer st.Close()
+	if _, err := st.Put(Note{Title: "edited in New York"}); err != nil {
+		fmt.Println("could not put note:", err)
+		t.FailNow()
+	}
+	hourAgo := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	for query, want := range map[string]int{
+		"edited:>=" + hourAgo: 1,
+		"edited:<" + hourAgo:  0,
+	} {
+		notes, _ := st.Search(query)
+		if len(notes) != want {
+			fmt.Println(query, "should find", want, "notes, found", len(notes))
+			t.Fail()
+		}
+	}
+}
+
+// Test_PostgresSearch needs database given by NOTEPET_TEST_POSTGRES_DSN
+// environment variable and is skipped if it is not set.
+func Test_PostgresSearch(t *testing.T) {
+	dsn := os.Getenv("NOTEPET_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("NOTEPET_TEST_POSTGRES_DSN is not set")
+	}
+	st, err := OpenPostgresStorageDSN(dsn)
+	if err != nil {
+		fmt.Println("could not connect to database:", err)
+		t.FailNow()
+	}
+	defer st.Close()
+	for _, n := range []Note{
+		{Title: "Groceries", Body: "buy milk and zqxdeploy bread", Tags: "home"},
+		{Title: "Zqxdeploy checklist", Body: "zqxdeploy the server after tests pass", Tags: "ops"},
+	} {
+		id, err := st.Put(n)
+		if err != nil {
+			fmt.Println("could not put note:", err)
+			t.FailNow()
+		}
+		defer st.Del(id)
+	}
+	results, err := SearchRanked(st, "zqxdeploy")
+	if err != nil || len(results) != 2 {
+		fmt.Println("SearchRanked returned wrong results:", results, err)
+		t.FailNow()
+	}
+	if results[0].Title != "Zqxdeploy checklist" || results[0].Rank < results[1].Rank {
+		fmt.Println("SearchRanked returned notes in wrong order:", results)
+		t.Fail()
+	}
+	// partial words are not in index and are matched as substrings
+	for _, query := range []string{"zqxdeplo", "qxdeploy the serv"} {
+		if results, err := SearchRanked(st, query); err != nil || len(results) == 0 {
+			fmt.Println("SearchRanked found nothing for", query, err)
+			t.Fail()
+		}
+		if notes, err := st.Search(query); err != nil || len(notes) == 0 {
+			fmt.Println("Search found nothing for", query, err)
+			t.Fail()
+		}
+	}
+	if _, err := SearchRanked(st, "zqxnosuchword"); err != ErrNoNotesFound {
+		fmt.Println("SearchRanked should return ErrNoNotesFound, got", err)
+		t.Fail()
+	}
+}
+
 /*
 func TestSqliteStorageConcurretly(t *testing.T) {
 	st, err := OpenOrInitSQLiteStorage(testDBfile)
@@ -189,3 +810,44 @@ func TestSqliteStorageConcurretly(t *testing.T) {
 	defer st.Close()
 }
 */
+
+// requireFTS is set by tests built with sqlite_fts5 tag so that
+// Test_SQLiteFullTextSearch fails instead of being skipped.
+var requireFTS bool
+
+func Test_SQLiteFullTextSearch(t *testing.T) {
+	testDBfile := "./test_fts.db"
+	os.Remove(testDBfile)
+	st, err := OpenOrInitSQLiteStorage(testDBfile)
+	if err != nil {
+		fmt.Println("could not create test_fts.db:", err)
+		t.FailNow()
+	}
+	defer os.Remove(testDBfile)
+	defer st.Close()
+	if !st.(*SQLiteStorage).fts {
+		if requireFTS {
+			t.Fatal("SQLite is built with sqlite_fts5 build tag but FTS5 is not available")
+		}
+		t.Skip("SQLite is built without FTS5, use sqlite_fts5 build tag")
+	}
+	st.Put(Note{Title: "Groceries", Body: "buy milk and deploy bread", Tags: "home"})
+	st.Put(Note{Title: "Deploy checklist", Body: "deploy the server after tests pass", Tags: "ops"})
+	results, err := SearchRanked(st, "deploy")
+	if err != nil || len(results) != 2 {
+		fmt.Println("SearchRanked returned wrong results:", results, err)
+		t.FailNow()
+	}
+	if results[0].Title != "Deploy checklist" || results[0].Rank < results[1].Rank {
+		fmt.Println("SearchRanked returned notes in wrong order:", results)
+		t.Fail()
+	}
+	if !strings.Contains(results[0].Snippet, SnippetMarkStart) {
+		fmt.Println("snippet has no marks:", results[0].Snippet)
+		t.Fail()
+	}
+	if results, err = SearchRanked(st, `"server after"`); err != nil || len(results) != 1 {
+		fmt.Println("phrase search returned wrong results:", results, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,249 @@
+package notepet
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// NDJSONContentType is media type of newline delimited JSON: one
+// JSON object per line. Server responds with it if request asks for
+// it in Accept header or with format=ndjson parameter.
+const NDJSONContentType = "application/x-ndjson"
+
+// NoteStreamer is implemented by Storage which can pass notes one by
+// one without loading all of them into memory. Notes are passed in the
+// order of Get (sticky notes first, then newest). Function passed to
+// StreamNotes must not call methods of the same Storage. If it returns
+// error streaming stops and the error is returned.
+type NoteStreamer interface {
+	StreamNotes(func(Note) error) error
+}
+
+// streamBatchSize is the number of notes read from database at once
+// by StreamNotes of SQL storages
+const streamBatchSize = 100
+
+// streamBatches calls read with offsets increasing by streamBatchSize
+// and fn for each note read until read returns less than
+// streamBatchSize notes. Nothing is being read while fn runs.
+func streamBatches(read func(offset int) ([]Note, error), fn func(Note) error) error {
+	for offset := 0; ; offset += streamBatchSize {
+		notes, err := read(offset)
+		if err != nil {
+			return err
+		}
+		for _, n := range notes {
+			if err := fn(n); err != nil {
+				return err
+			}
+		}
+		if len(notes) < streamBatchSize {
+			return nil
+		}
+	}
+}
+
+// StreamNotes calls fn for each note in st. If st does not implement
+// NoteStreamer notes are fetched with Get. Empty st is not an error.
+func StreamNotes(st Storage, fn func(Note) error) error {
+	if st == nil {
+		return ErrStorageIsNil
+	}
+	if ns, ok := st.(NoteStreamer); ok {
+		return ns.StreamNotes(fn)
+	}
+	notes, err := st.Get()
+	if err != nil && err != ErrNoNotesFound {
+		return err
+	}
+	for _, n := range notes {
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportJSONTo writes all notes of st to w as JSON array
+// without keeping them all in memory.
+func ExportJSONTo(w io.Writer, st Storage) error {
+	return exportTo(newJSONStream(w, false), st)
+}
+
+// ExportNDJSON writes all notes of st to w one per line
+func ExportNDJSON(w io.Writer, st Storage) error {
+	return exportTo(newJSONStream(w, true), st)
+}
+
+func exportTo(js *jsonStream, st Storage) error {
+	err := StreamNotes(st, func(n Note) error {
+		return js.Write(n)
+	})
+	if err != nil {
+		return err
+	}
+	return js.Close()
+}
+
+// DecodeNotes reads notes from r calling fn for each of them as soon as
+// it is decoded. Input may be JSON array of notes or NDJSON.
+func DecodeNotes(r io.Reader, fn func(Note) error) error {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !unicode.IsSpace(c) {
+			br.UnreadRune()
+			break
+		}
+	}
+	dec := json.NewDecoder(br)
+	array := false
+	if c, _ := br.Peek(1); len(c) == 1 && c[0] == '[' {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		array = true
+	}
+	for dec.More() {
+		var n Note
+		if err := dec.Decode(&n); err != nil {
+			return err
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+	if array {
+		_, err := dec.Token()
+		return err
+	}
+	return nil
+}
+
+// jsonStream writes values one by one either as elements of JSON array
+// (formatted as noteListToBytes does) or as NDJSON lines.
+type jsonStream struct {
+	w      io.Writer
+	ndjson bool
+	count  int
+}
+
+func newJSONStream(w io.Writer, ndjson bool) *jsonStream {
+	return &jsonStream{w: w, ndjson: ndjson}
+}
+
+// Write encodes v and writes it out
+func (js *jsonStream) Write(v interface{}) error {
+	var data []byte
+	var err error
+	if js.ndjson {
+		data, err = json.Marshal(v)
+		data = append(data, '\n')
+	} else {
+		data, err = json.MarshalIndent(v, "    ", "    ")
+		sep := ",\n    "
+		if js.count == 0 {
+			sep = "[\n    "
+		}
+		data = append([]byte(sep), data...)
+	}
+	if err != nil {
+		return err
+	}
+	js.count++
+	_, err = js.w.Write(data)
+	return err
+}
+
+// Close finishes JSON array. It does nothing for NDJSON.
+func (js *jsonStream) Close() error {
+	if js.ndjson {
+		return nil
+	}
+	end := "\n]"
+	if js.count == 0 {
+		end = "[]"
+	}
+	_, err := io.WriteString(js.w, end)
+	return err
+}
+
+// streamAll passes all notes of st to writeJSONStream as they are read
+func streamAll(st Storage) func(func(interface{}) error) error {
+	return func(write func(interface{}) error) error {
+		return StreamNotes(st, func(n Note) error { return write(n) })
+	}
+}
+
+// streamList passes notes to writeJSONStream
+func streamList(notes []Note) func(func(interface{}) error) error {
+	return func(write func(interface{}) error) error {
+		for _, n := range notes {
+			if err := write(n); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// isFullList reports whether opts request all notes in default order
+// so that they can be streamed from storage.
+func isFullList(opts ListOptions) bool {
+	return opts.Limit == 0 && opts.Offset == 0 && len(opts.Tags) == 0 && opts.Sort == SortStickyFirst
+}
+
+// wantsNDJSON reports whether client asked for NDJSON response
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" ||
+		strings.Contains(r.Header.Get("Accept"), NDJSONContentType)
+}
+
+// writeJSONStream writes values passed by each to the response one by
+// one as JSON array or NDJSON depending on request. Header and status
+// are written with the first value, so if each fails before it the error
+// is returned to be reported to client. So is emptyErr if each passes no
+// values (otherwise empty list is written). Errors after the first value
+// only cut response short.
+func writeJSONStream(w http.ResponseWriter, r *http.Request, emptyErr error, each func(write func(interface{}) error) error) error {
+	ndjson := wantsNDJSON(r)
+	js := newJSONStream(w, ndjson)
+	start := func() {
+		if ndjson {
+			w.Header().Set("Content-Type", NDJSONContentType)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	err := each(func(v interface{}) error {
+		if js.count == 0 {
+			start()
+		}
+		return js.Write(v)
+	})
+	switch {
+	case js.count == 0 && err != nil:
+		return err
+	case js.count == 0 && emptyErr != nil:
+		return emptyErr
+	case js.count == 0:
+		start()
+	case err != nil:
+		log.Println("error streaming response:", err)
+		return nil
+	}
+	js.Close()
+	return nil
+}
@@ -0,0 +1,295 @@
+package notepet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replica is a local copy of notes kept in remote Storage (usually
+// APIClient). It implements Storage: notes may be read and changed while
+// remote is not available and changes are sent to remote by Sync.
+// Replica remembers versions of notes as of the last synchronization and
+// keeps tombstones of deleted notes in a state file, so that Sync can tell
+// which side has changed or deleted a note.
+type Replica struct {
+	Storage // local storage
+	remote  Storage
+	mu      sync.Mutex
+	file    string // state file
+	state   replicaState
+}
+
+// replicaState is kept in state file of Replica between synchronizations
+type replicaState struct {
+	LastSync time.Time             `json:"last_sync"`
+	Notes    map[NoteID]syncedNote `json:"notes"`
+	Deleted  map[NoteID]time.Time  `json:"deleted,omitempty"`
+}
+
+// syncedNote holds LastEdited of note on both sides after the last
+// synchronization. Note has been changed on either side since then
+// if its LastEdited is different.
+type syncedNote struct {
+	Local  time.Time `json:"local"`
+	Remote time.Time `json:"remote"`
+}
+
+// SyncReport lists IDs of notes by what Sync has done with them
+type SyncReport struct {
+	Pulled        []NoteID `json:"pulled"`         // added or updated in local storage
+	Pushed        []NoteID `json:"pushed"`         // added or updated in remote storage
+	DeletedLocal  []NoteID `json:"deleted_local"`  // deleted from local storage
+	DeletedRemote []NoteID `json:"deleted_remote"` // deleted from remote storage
+	Conflicts     []NoteID `json:"conflicts"`      // changed on both sides
+}
+
+// OpenReplica returns Replica keeping notes of remote in local. State of
+// synchronization is kept in statefile which is created if it does not exist.
+// Remote may be nil if Replica is only used offline.
+func OpenReplica(local, remote Storage, statefile string) (*Replica, error) {
+	if local == nil {
+		return nil, ErrStorageIsNil
+	}
+	r := Replica{Storage: local, remote: remote, file: statefile}
+	data, err := ioutil.ReadFile(statefile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			return nil, err
+		}
+	}
+	if r.state.Notes == nil {
+		r.state.Notes = make(map[NoteID]syncedNote)
+	}
+	if r.state.Deleted == nil {
+		r.state.Deleted = make(map[NoteID]time.Time)
+	}
+	return &r, nil
+}
+
+// OpenSQLiteReplica opens or creates SQLite database filename as local
+// storage of Replica. State file is kept next to it with ".sync" suffix.
+func OpenSQLiteReplica(filename string, remote Storage) (*Replica, error) {
+	local, err := OpenOrInitSQLiteStorage(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := OpenReplica(local, remote, filename+".sync")
+	if err != nil {
+		local.Close()
+	}
+	return r, err
+}
+
+// Del deletes note from local storage and keeps
+// tombstone of it until the next Sync.
+func (r *Replica) Del(id NoteID) error {
+	if err := r.Storage.Del(id); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.Deleted[id] = time.Now()
+	return r.saveState()
+}
+
+// LastSync returns time of the last successful Sync
+func (r *Replica) LastSync() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.LastSync
+}
+
+// Sync reconciles local storage with remote one. Note changed on one
+// side only replaces its version on the other side, note deleted on one
+// side and not changed on the other one is deleted on both sides. If note
+// has been changed on both sides the remote version is kept under its ID
+// and the local version is added to both storages as a new note with
+// "(conflict copy)" in its title, so that nothing is lost.
+// If some notes could not be synchronized the first error is returned
+// and they are retried by the next Sync.
+func (r *Replica) Sync() (SyncReport, error) {
+	var report SyncReport
+	if r.remote == nil {
+		return report, ErrStorageIsNil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	local, err := notesByID(r.Storage)
+	if err != nil {
+		return report, err
+	}
+	remote, err := notesByID(r.remote)
+	if err != nil {
+		return report, err
+	}
+	ids := make([]NoteID, 0, len(local))
+	seen := make(map[NoteID]bool)
+	for _, set := range []map[NoteID]Note{local, remote} {
+		for id := range set {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	next := make(map[NoteID]syncedNote, len(ids))
+	deleted := make(map[NoteID]time.Time)
+	var firstErr error
+	for _, id := range ids {
+		l, inLocal := local[id]
+		rn, inRemote := remote[id]
+		base, synced := r.state.Notes[id]
+		_, deletedLocally := r.state.Deleted[id]
+		localChanged := !synced || !l.LastEdited.Equal(base.Local)
+		remoteChanged := !synced || !rn.LastEdited.Equal(base.Remote)
+		var err error
+		switch {
+		case inLocal && inRemote && sameContent(l, rn):
+			next[id] = syncedNote{l.LastEdited, rn.LastEdited}
+		case inLocal && inRemote && localChanged && remoteChanged:
+			if err = r.resolveConflict(l, rn, next); err == nil {
+				report.Conflicts = append(report.Conflicts, id)
+			}
+		case inLocal && inRemote && localChanged:
+			if err = r.push(l, true, next); err == nil {
+				report.Pushed = append(report.Pushed, id)
+			}
+		case inLocal && inRemote:
+			if err = r.pull(rn, true, next); err == nil {
+				report.Pulled = append(report.Pulled, id)
+			}
+		case inLocal && synced && !localChanged:
+			// deleted on remote
+			if err = r.Storage.Del(id); err == nil {
+				report.DeletedLocal = append(report.DeletedLocal, id)
+			}
+		case inLocal:
+			if err = r.push(l, false, next); err == nil {
+				report.Pushed = append(report.Pushed, id)
+			}
+		case (synced || deletedLocally) && !remoteChanged:
+			// deleted locally
+			if err = r.remote.Del(id); err == nil {
+				report.DeletedRemote = append(report.DeletedRemote, id)
+			}
+		default:
+			if err = r.pull(rn, false, next); err == nil {
+				report.Pulled = append(report.Pulled, id)
+			}
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error synchronizing note %v: %w", id, err)
+			}
+			if synced {
+				next[id] = base
+			}
+			if deletedLocally {
+				deleted[id] = r.state.Deleted[id]
+			}
+		}
+	}
+	r.state.Notes = next
+	r.state.Deleted = deleted
+	if firstErr == nil {
+		r.state.LastSync = time.Now()
+	}
+	if err := r.saveState(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return report, firstErr
+}
+
+// push adds or updates note in remote storage. If remote has stored
+// note under another ID local note is moved to that ID.
+func (r *Replica) push(n Note, exists bool, next map[NoteID]syncedNote) error {
+	var id NoteID
+	var err error
+	if exists {
+		id, err = r.remote.Upd(n.ID, n)
+	} else {
+		id, err = r.remote.Put(n)
+	}
+	if err != nil {
+		return err
+	}
+	pushed, err := r.remote.Get(id)
+	if err != nil {
+		return err
+	}
+	if len(pushed) != 1 {
+		return ErrNoNotesFound
+	}
+	if id != n.ID {
+		if err := r.pull(pushed[0], false, next); err != nil {
+			return err
+		}
+		return r.Storage.Del(n.ID)
+	}
+	next[id] = syncedNote{n.LastEdited, pushed[0].LastEdited}
+	return nil
+}
+
+// pull adds or replaces note in local storage verbatim
+func (r *Replica) pull(n Note, exists bool, next map[NoteID]syncedNote) error {
+	var err error
+	if exists {
+		err = ReplaceNote(r.Storage, n)
+	} else {
+		_, err = ImportNote(r.Storage, n)
+	}
+	if err != nil {
+		return err
+	}
+	next[n.ID] = syncedNote{n.LastEdited, n.LastEdited}
+	return nil
+}
+
+// resolveConflict keeps remote version of note under its ID and
+// adds local version to both storages as a new note.
+func (r *Replica) resolveConflict(l, rn Note, next map[NoteID]syncedNote) error {
+	if err := r.pull(rn, true, next); err != nil {
+		return err
+	}
+	dup := l
+	dup.ID = ""
+	dup.Title = fmt.Sprintf("%s (conflict copy %s)", l.Title, time.Now().Format("2006-01-02 15:04"))
+	id, err := r.Storage.Put(dup)
+	if err != nil {
+		return err
+	}
+	added, err := r.Storage.Get(id)
+	if err != nil {
+		return err
+	}
+	if len(added) != 1 {
+		return ErrNoNotesFound
+	}
+	return r.push(added[0], false, next)
+}
+
+// saveState writes state to file. Caller should hold r.mu.
+func (r *Replica) saveState() error {
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.file, data, 0664)
+}
+
+func notesByID(st Storage) (map[NoteID]Note, error) {
+	notes := make(map[NoteID]Note)
+	err := StreamNotes(st, func(n Note) error {
+		notes[n.ID] = n
+		return nil
+	})
+	return notes, err
+}
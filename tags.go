@@ -0,0 +1,126 @@
+package notepet
+
+import (
+	"sort"
+	"strings"
+)
+
+// TagCount holds a tag and number of notes marked with it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// TagStorage is implemented by Storage which can look up notes
+// by their tags.
+type TagStorage interface {
+	// Tags returns all tags used in Storage with number of notes
+	// marked with each tag.
+	Tags() ([]TagCount, error)
+	// GetByTags returns notes marked with all of the requested tags
+	// if the bool argument is true or with any of them otherwise.
+	// Empty list of tags matches no notes.
+	GetByTags([]string, bool) ([]Note, error)
+}
+
+// ParseTags splits string with tags separated by spaces or commas into
+// a set of lowercase tags sorted alphabetically.
+func ParseTags(s string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	set := make(map[string]struct{}, len(fields))
+	tags := []string{}
+	for _, tag := range fields {
+		if _, ok := set[tag]; !ok {
+			set[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// NormalizeTags returns tags from s in canonical form: lowercase,
+// without duplicates, sorted and separated by single spaces.
+// This is the form in which storages keep Note.Tags.
+func NormalizeTags(s string) string {
+	return strings.Join(ParseTags(s), " ")
+}
+
+// TagList returns tags of the note as a set
+func (n Note) TagList() []string {
+	return ParseTags(n.Tags)
+}
+
+// HasTags reports whether note is marked with all of tags (if all is true)
+// or with any of them. Empty list of tags matches no notes.
+func (n Note) HasTags(tags []string, all bool) bool {
+	if len(ParseTags(strings.Join(tags, " "))) == 0 {
+		return false
+	}
+	have := make(map[string]struct{})
+	for _, tag := range n.TagList() {
+		have[tag] = struct{}{}
+	}
+	for _, tag := range tags {
+		_, ok := have[strings.ToLower(tag)]
+		if ok && !all {
+			return true
+		}
+		if !ok && all {
+			return false
+		}
+	}
+	return all
+}
+
+// GetByTags returns notes from st marked with all of tags (if all is true)
+// or any of them. If st does not implement TagStorage all notes are
+// fetched and filtered. Empty list of tags matches no notes.
+func GetByTags(st Storage, tags []string, all bool) ([]Note, error) {
+	if st == nil {
+		return []Note{}, ErrStorageIsNil
+	}
+	if len(ParseTags(strings.Join(tags, " "))) == 0 {
+		return []Note{}, ErrNoNotesFound
+	}
+	if ts, ok := st.(TagStorage); ok {
+		return ts.GetByTags(tags, all)
+	}
+	notes, err := st.Get()
+	if err != nil {
+		return notes, err
+	}
+	return filterByTags(notes, tags, all)
+}
+
+// CountTags returns tags found in notes with number of notes
+// marked with each one sorted by tag.
+func CountTags(notes []Note) []TagCount {
+	counts := make(map[string]int)
+	for _, n := range notes {
+		for _, tag := range n.TagList() {
+			counts[tag]++
+		}
+	}
+	result := make([]TagCount, 0, len(counts))
+	for tag, count := range counts {
+		result = append(result, TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Tag < result[j].Tag })
+	return result
+}
+
+func filterByTags(notes []Note, tags []string, all bool) ([]Note, error) {
+	result := []Note{}
+	for _, n := range notes {
+		if n.HasTags(tags, all) {
+			result = append(result, n)
+		}
+	}
+	if len(result) == 0 {
+		return result, ErrNoNotesFound
+	}
+	return result, nil
+}
@@ -0,0 +1,361 @@
+package notepet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSuchToken is returned when there is no token with requested ID
+var ErrNoSuchToken = errors.New("error: no such token")
+
+// Token is a record of token kept by TokenStore. Token itself is
+// never kept: only SHA-256 hash of random salt followed by token.
+type Token struct {
+	ID       string    `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	User     User      `json:"user"`
+	Salt     string    `json:"salt"` // hex
+	Hash     string    `json:"hash"` // hex
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"` // zero time never expires
+	LastUsed time.Time `json:"lastused,omitempty"`
+}
+
+// Expired reports whether t is expired at moment now
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && !now.Before(t.Expires)
+}
+
+// matches reports in constant time whether t is a record of token
+func (t *Token) matches(token string) bool {
+	salt, err := hex.DecodeString(t.Salt)
+	if err != nil {
+		return false
+	}
+	hash, err := hex.DecodeString(t.Hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hashToken(salt, token), hash) == 1
+}
+
+// hashToken returns SHA-256 of salt followed by token
+func hashToken(salt []byte, token string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return h.Sum(nil)
+}
+
+// randomString returns n random bytes encoded with enc
+func randomString(n int, enc func([]byte) string) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return enc(b), nil
+}
+
+// newToken returns record of token with new ID and salt
+func newToken(token, label string, u User, expires time.Time) (*Token, error) {
+	id, err := randomString(6, hex.EncodeToString)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &Token{
+		ID:      id,
+		Label:   label,
+		User:    u,
+		Salt:    hex.EncodeToString(salt),
+		Hash:    hex.EncodeToString(hashToken(salt, token)),
+		Created: time.Now().UTC(),
+		Expires: expires,
+	}, nil
+}
+
+// TokenStore authenticates users by tokens. Tokens are read from file
+// (see OpenTokenStore) or registered with Add. Only salted hashes of
+// tokens are kept and each token is checked against all of them in
+// constant time.
+type TokenStore struct {
+	mu       sync.Mutex
+	filename string
+	legacy   bool     // file holds plain tokens
+	file     []*Token // tokens read from file
+	static   []*Token // tokens added with Add, never saved to file
+}
+
+// NewTokenStore returns empty TokenStore not backed by file
+func NewTokenStore() *TokenStore {
+	return &TokenStore{}
+}
+
+// OpenTokenStore reads tokens from file. Missing file is treated as
+// empty one and is created by the first Save.
+//
+// File is a JSON array of Token. Files of earlier versions holding plain
+// tokens are also read: lines of form user:token[:role[:groups]] are
+// tokens of users (see ParseUserToken), other non-empty lines not starting
+// with # are tokens of admins without name. Such files are hashed in
+// memory and are rewritten with hashes by Save.
+func OpenTokenStore(filename string) (*TokenStore, error) {
+	ts := &TokenStore{filename: filename}
+	if err := ts.Reload(); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Legacy reports whether file of ts holds plain tokens
+func (ts *TokenStore) Legacy() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.legacy
+}
+
+// Reload reads tokens from file again replacing the ones read earlier.
+// Last used times of tokens are kept if they are later than in file.
+// Tokens added with Add are not affected.
+func (ts *TokenStore) Reload() error {
+	if ts.filename == "" {
+		return nil
+	}
+	tokens, legacy, err := readTokensFile(ts.filename)
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !legacy {
+		mergeLastUsed(tokens, ts.file)
+	}
+	ts.file, ts.legacy = tokens, legacy
+	return nil
+}
+
+// Save writes tokens to file of ts. Tokens are reread before saving so
+// that changes made by another process are not lost: tokens revoked by
+// it stay revoked and last used times of tokens in memory are saved.
+// Files holding plain tokens are rewritten with hashes.
+func (ts *TokenStore) Save() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.update(func() error { return nil })
+}
+
+// update rereads file, applies fn to ts.file and saves result.
+// Caller should hold ts.mu.
+func (ts *TokenStore) update(fn func() error) error {
+	if ts.filename != "" && !ts.legacy {
+		ondisk, _, err := readTokensFile(ts.filename)
+		if err != nil {
+			return err
+		}
+		mergeLastUsed(ondisk, ts.file)
+		ts.file = ondisk
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if ts.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(ts.file, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := ts.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ts.filename); err != nil {
+		return err
+	}
+	ts.legacy = false
+	return nil
+}
+
+// Add registers token authenticating u. Tokens added with Add are kept
+// in memory only.
+func (ts *TokenStore) Add(token string, u User) error {
+	t, err := newToken(token, "", u, time.Time{})
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.static = append(ts.static, t)
+	return nil
+}
+
+// Create generates new random token authenticating u, saves its hash
+// to file and returns token along with its record. Token expires at
+// expires unless it is zero time.
+func (ts *TokenStore) Create(label string, u User, expires time.Time) (string, Token, error) {
+	token, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", Token{}, err
+	}
+	t, err := newToken(token, label, u, expires)
+	if err != nil {
+		return "", Token{}, err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err := ts.update(func() error {
+		ts.file = append(ts.file, t)
+		return nil
+	}); err != nil {
+		return "", Token{}, err
+	}
+	return token, *t, nil
+}
+
+// List returns records of tokens read from file ordered by creation time
+func (ts *TokenStore) List() []Token {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]Token, 0, len(ts.file))
+	for _, t := range ts.file {
+		list = append(list, *t)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Revoke removes token with id from file
+func (ts *TokenStore) Revoke(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.update(func() error {
+		for i, t := range ts.file {
+			if t.ID == id {
+				ts.file = append(ts.file[:i], ts.file[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNoSuchToken
+	})
+}
+
+// Expire makes token with id expire at moment at
+func (ts *TokenStore) Expire(id string, at time.Time) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.update(func() error {
+		for _, t := range ts.file {
+			if t.ID == id {
+				t.Expires = at.UTC()
+				return nil
+			}
+		}
+		return ErrNoSuchToken
+	})
+}
+
+// Authenticate implements Authenticator. Token is taken
+// from Notepet-Token header of request.
+func (ts *TokenStore) Authenticate(r *http.Request) (User, error) {
+	token := r.Header.Get("Notepet-Token")
+	if token == "" {
+		return User{}, ErrNoCredentials
+	}
+	u, ok := ts.Lookup(token)
+	if !ok {
+		return User{}, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+// Lookup returns User authenticated by token. Token is compared
+// with all known tokens so that time taken does not depend on which one
+// of them (if any) matches. Last used time of matching token is updated.
+func (ts *TokenStore) Lookup(token string) (User, bool) {
+	if token == "" {
+		return User{}, false
+	}
+	now := time.Now().UTC()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var found *Token
+	for _, list := range [][]*Token{ts.file, ts.static} {
+		for _, t := range list {
+			if t.matches(token) && found == nil {
+				found = t
+			}
+		}
+	}
+	if found == nil || found.Expired(now) {
+		return User{}, false
+	}
+	found.LastUsed = now
+	return found.User, true
+}
+
+// readTokensFile reads records of tokens from file. legacy is true if
+// file holds plain tokens (see OpenTokenStore).
+func readTokensFile(filename string) (tokens []*Token, legacy bool, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return []*Token{}, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] == '[' {
+		tokens = []*Token{}
+		if len(trimmed) > 0 {
+			err = json.Unmarshal(trimmed, &tokens)
+		}
+		return tokens, false, err
+	}
+	tokens = []*Token{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, token := User{Role: RoleAdmin}, line
+		if strings.Contains(line, ":") {
+			if u, token, err = ParseUserToken(line); err != nil {
+				return nil, true, err
+			}
+		}
+		t, err := newToken(token, "", u, time.Time{})
+		if err != nil {
+			return nil, true, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, true, nil
+}
+
+// mergeLastUsed copies last used times of tokens in memory to
+// tokens read from file if they are later
+func mergeLastUsed(ondisk, inmemory []*Token) {
+	used := make(map[string]time.Time)
+	for _, t := range inmemory {
+		used[t.ID] = t.LastUsed
+	}
+	for _, t := range ondisk {
+		if last, ok := used[t.ID]; ok && last.After(t.LastUsed) {
+			t.LastUsed = last
+		}
+	}
+}
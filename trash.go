@@ -0,0 +1,43 @@
+package notepet
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoteExists is returned when note can not be put to Storage
+// because a note with the same NoteID is already there.
+var ErrNoteExists = errors.New("error: note with such NoteID already exists")
+
+// DeletedNote is a Note which has been deleted from Storage and
+// is kept in trash.
+type DeletedNote struct {
+	Note
+	Deleted time.Time `json:"deleted"`
+}
+
+// TrashStorage is implemented by Storage which moves deleted notes
+// to trash instead of removing them permanently.
+type TrashStorage interface {
+	// Trash returns notes in trash, most recently deleted first.
+	Trash() ([]DeletedNote, error)
+	// Undelete moves Note with NoteID from trash back to Storage.
+	Undelete(NoteID) error
+	// EmptyTrash permanently removes notes deleted before specified
+	// time and returns number of removed notes.
+	EmptyTrash(time.Time) (int, error)
+}
+
+// PurgeTrash permanently removes notes which have been in trash for
+// longer than retention. It does nothing if st does not implement
+// TrashStorage.
+func PurgeTrash(st Storage, retention time.Duration) (int, error) {
+	if st == nil {
+		return 0, ErrStorageIsNil
+	}
+	ts, ok := st.(TrashStorage)
+	if !ok {
+		return 0, nil
+	}
+	return ts.EmptyTrash(time.Now().Add(-retention))
+}
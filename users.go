@@ -0,0 +1,450 @@
+package notepet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Roles of users
+const (
+	RoleUser  = "user"  // sees only own notes
+	RoleAdmin = "admin" // sees all notes
+)
+
+// Scopes limit actions which may be done with token. Token with
+// ScopeAdmin may do everything as may tokens without scopes.
+const (
+	ScopeNotesRead   = "notes:read"   // get, search and watch notes
+	ScopeNotesWrite  = "notes:write"  // create, update, restore and share notes
+	ScopeNotesDelete = "notes:delete" // delete notes
+	ScopeAdmin       = "admin"        // all of the above and empty trash
+)
+
+// ParseScopes parses comma separated list of scopes
+func ParseScopes(s string) ([]string, error) {
+	scopes := []string{}
+	for _, scope := range strings.Split(s, ",") {
+		switch scope = strings.TrimSpace(scope); scope {
+		case "":
+		case ScopeNotesRead, ScopeNotesWrite, ScopeNotesDelete, ScopeAdmin:
+			scopes = append(scopes, scope)
+		default:
+			return nil, fmt.Errorf("invalid scope %q: want %v, %v, %v or %v", scope, ScopeNotesRead, ScopeNotesWrite, ScopeNotesDelete, ScopeAdmin)
+		}
+	}
+	return scopes, nil
+}
+
+// ErrPermissionDenied is returned when user is not allowed to do
+// requested action.
+var ErrPermissionDenied = errors.New("error: permission denied")
+
+// User is an account of notepetsrv identified by token. Notes
+// may be shared with user by name or with groups user belongs to.
+// Scopes are granted to user by token (all of them if empty).
+type User struct {
+	Name   string   `json:"name"`
+	Role   string   `json:"role"`
+	Groups []string `json:"groups,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// ValidUserName reports whether name may be name of user. Names
+// starting with GroupPrefix stand for groups in shares.
+func ValidUserName(name string) bool {
+	return !strings.HasPrefix(name, GroupPrefix)
+}
+
+// IsAdmin reports whether u may see and modify all notes
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// HasScope reports whether u is allowed to do actions of scope
+func (u User) HasScope(scope string) bool {
+	if len(u.Scopes) == 0 {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseUserToken parses line of tokens file of form
+// "user:token[:role[:group,group...[:scope,scope...]]]".
+// Role defaults to RoleUser.
+func ParseUserToken(line string) (User, string, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), ":", 5)
+	if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+		return User{}, "", fmt.Errorf("invalid user token %q: want user:token[:role[:groups[:scopes]]]", line)
+	}
+	if !ValidUserName(fields[0]) {
+		return User{}, "", fmt.Errorf("invalid user name %q: must not start with %q", fields[0], GroupPrefix)
+	}
+	u := User{Name: fields[0], Role: RoleUser}
+	if len(fields) > 2 && fields[2] != "" {
+		u.Role = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != "" {
+		u.Groups = strings.Split(fields[3], ",")
+	}
+	if len(fields) > 4 {
+		scopes, err := ParseScopes(fields[4])
+		if err != nil {
+			return User{}, "", err
+		}
+		u.Scopes = scopes
+	}
+	if u.Role != RoleUser && u.Role != RoleAdmin {
+		return User{}, "", fmt.Errorf("invalid role %q of user %v", u.Role, u.Name)
+	}
+	return u, fields[1], nil
+}
+
+// userKey is a key of authenticated User in request context
+type userKey struct{}
+
+// withUser returns copy of r carrying u
+func withUser(r *http.Request, u User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, u))
+}
+
+// requestUser returns User who has made authenticated request
+func requestUser(r *http.Request) User {
+	u, _ := r.Context().Value(userKey{}).(User)
+	return u
+}
+
+// ForUser returns st as seen by u. Admins get st itself. Other users
+// get Storage holding only notes they own or which are shared with
+// them: notes they add are owned by them and notes of others look like
+// they do not exist. Shared notes can be updated only if they are shared
+// with AccessReadWrite. Only owners may delete and share notes.
+func ForUser(st Storage, u User) Storage {
+	if st == nil || u.IsAdmin() {
+		return st
+	}
+	return &userStorage{st: st, user: u}
+}
+
+// userStorage is Storage restricted to notes accessible to single user.
+// Optional interfaces of underlying storage are passed through when
+// access to notes can be checked. Others are left out so that generic
+// fallbacks based on Get do the job.
+type userStorage struct {
+	st   Storage
+	user User
+}
+
+// accessOwner is access of user to own notes
+const accessOwner = "owner"
+
+// shared returns access to notes shared with s.user
+func (s *userStorage) shared() map[NoteID]string {
+	ss, ok := s.st.(ShareStorage)
+	if !ok {
+		return map[NoteID]string{}
+	}
+	shares, err := ss.SharedWith(s.user.grantees())
+	if err != nil {
+		return map[NoteID]string{}
+	}
+	return sharedAccess(shares)
+}
+
+// access returns access of s.user to n given shares from s.shared
+func (s *userStorage) access(n Note, shared map[NoteID]string) string {
+	if n.Owner == s.user.Name {
+		return accessOwner
+	}
+	return shared[n.ID]
+}
+
+// own returns notes accessible to s.user
+func (s *userStorage) own(notes []Note, err error) ([]Note, error) {
+	shared := s.shared()
+	owned := []Note{}
+	for _, n := range notes {
+		if s.access(n, shared) != "" {
+			owned = append(owned, n)
+		}
+	}
+	if err == nil && len(owned) == 0 && len(notes) > 0 {
+		err = ErrNoNotesFound
+	}
+	return owned, err
+}
+
+// check returns ErrNoNotesFound if s.user can not see note with id
+// and ErrPermissionDenied if s.user has no access needed for
+// action (one of accessOwner, AccessReadWrite or AccessRead).
+func (s *userStorage) check(id NoteID, need string) error {
+	notes, err := s.st.Get(id)
+	if err != nil {
+		return err
+	}
+	if len(notes) == 0 {
+		return ErrNoNotesFound
+	}
+	switch access := s.access(notes[0], s.shared()); {
+	case access == "":
+		return ErrNoNotesFound
+	case access == accessOwner, need == AccessRead, need == access:
+		return nil
+	}
+	return ErrPermissionDenied
+}
+
+// trashed returns IDs of notes in trash accessible to s.user
+// given shares from s.shared
+func (s *userStorage) trashed(shared map[NoteID]string) map[NoteID]struct{} {
+	ids := make(map[NoteID]struct{})
+	ts, ok := s.st.(TrashStorage)
+	if !ok {
+		return ids
+	}
+	notes, _ := ts.Trash()
+	for _, n := range notes {
+		if s.access(n.Note, shared) != "" {
+			ids[n.ID] = struct{}{}
+		}
+	}
+	return ids
+}
+
+func (s *userStorage) Get(ids ...NoteID) ([]Note, error) {
+	return s.own(s.st.Get(ids...))
+}
+
+func (s *userStorage) Put(n Note) (NoteID, error) {
+	n.Owner = s.user.Name
+	return s.st.Put(n)
+}
+
+func (s *userStorage) Upd(id NoteID, n Note) (NoteID, error) {
+	if err := s.check(id, AccessReadWrite); err != nil {
+		return BadNoteID, err
+	}
+	return s.st.Upd(id, n)
+}
+
+func (s *userStorage) Del(id NoteID) error {
+	if err := s.check(id, accessOwner); err != nil {
+		return err
+	}
+	return s.st.Del(id)
+}
+
+func (s *userStorage) Search(query string) ([]Note, error) {
+	return s.own(s.st.Search(query))
+}
+
+func (s *userStorage) Close() error {
+	return s.st.Close()
+}
+
+// SearchRanked implements RankedSearcher
+func (s *userStorage) SearchRanked(query string) ([]SearchResult, error) {
+	found, err := SearchRanked(s.st, query)
+	shared := s.shared()
+	results := []SearchResult{}
+	for _, r := range found {
+		if s.access(r.Note, shared) != "" {
+			results = append(results, r)
+		}
+	}
+	if err == nil && len(results) == 0 {
+		err = ErrNoNotesFound
+	}
+	return results, err
+}
+
+// StreamNotes implements NoteStreamer
+func (s *userStorage) StreamNotes(fn func(Note) error) error {
+	shared := s.shared()
+	return StreamNotes(s.st, func(n Note) error {
+		if s.access(n, shared) == "" {
+			return nil
+		}
+		return fn(n)
+	})
+}
+
+// Patch implements Patcher
+func (s *userStorage) Patch(id NoteID, p NotePatch) (NoteID, error) {
+	if err := s.check(id, AccessReadWrite); err != nil {
+		return BadNoteID, err
+	}
+	return PatchNote(s.st, id, p)
+}
+
+// History implements HistoryStorage
+func (s *userStorage) History(id NoteID) ([]Revision, error) {
+	hs, ok := s.st.(HistoryStorage)
+	if !ok {
+		return []Revision{}, errors.New("error: storage does not keep history")
+	}
+	if err := s.check(id, AccessRead); err != nil {
+		return []Revision{}, err
+	}
+	return hs.History(id)
+}
+
+// Revision implements HistoryStorage
+func (s *userStorage) Revision(id NoteID, rev int) (Revision, error) {
+	hs, ok := s.st.(HistoryStorage)
+	if !ok {
+		return Revision{}, errors.New("error: storage does not keep history")
+	}
+	if err := s.check(id, AccessRead); err != nil {
+		return Revision{}, err
+	}
+	return hs.Revision(id, rev)
+}
+
+// Trash implements TrashStorage. Users see only their own deleted notes.
+func (s *userStorage) Trash() ([]DeletedNote, error) {
+	owned := []DeletedNote{}
+	ts, ok := s.st.(TrashStorage)
+	if !ok {
+		return owned, nil
+	}
+	notes, err := ts.Trash()
+	for _, n := range notes {
+		if n.Owner == s.user.Name {
+			owned = append(owned, n)
+		}
+	}
+	return owned, err
+}
+
+// Undelete implements TrashStorage
+func (s *userStorage) Undelete(id NoteID) error {
+	ts, ok := s.st.(TrashStorage)
+	if !ok {
+		return ErrNoNotesFound
+	}
+	notes, err := s.Trash()
+	if err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if n.ID == id {
+			return ts.Undelete(id)
+		}
+	}
+	return ErrNoNotesFound
+}
+
+// EmptyTrash implements TrashStorage. Trash is shared by all users
+// so only admins may empty it.
+func (s *userStorage) EmptyTrash(time.Time) (int, error) {
+	return 0, ErrPermissionDenied
+}
+
+// Changes implements ChangeStorage. Deletions are reported
+// while deleted notes are kept in trash.
+func (s *userStorage) Changes(since int64, limit int) ([]Change, error) {
+	feed, err := Changes(s.st, since, 0)
+	return s.visibleChanges(feed.Changes, limit), err
+}
+
+// ChangesAfter implements ChangeTimeStorage. Changes are filtered
+// as by Changes.
+func (s *userStorage) ChangesAfter(t time.Time, limit int) ([]Change, int64, error) {
+	feed, err := ChangesSince(s.st, t, 0)
+	return s.visibleChanges(feed.Changes, limit), feed.Last, err
+}
+
+// visibleChanges returns first limit (all if limit is not positive)
+// of changes which are visible to user
+func (s *userStorage) visibleChanges(all []Change, limit int) []Change {
+	shared := s.shared()
+	trashed := s.trashed(shared)
+	changes := []Change{}
+	for _, c := range all {
+		_, deleted := trashed[c.ID]
+		if c.Note != nil && s.access(*c.Note, shared) != "" || c.Deleted && deleted {
+			changes = append(changes, c)
+		}
+	}
+	if limit > 0 && len(changes) > limit {
+		changes = changes[:limit]
+	}
+	return changes
+}
+
+// Shares implements ShareStorage. Shares of note are visible
+// to everyone who can see the note.
+func (s *userStorage) Shares(id NoteID) ([]Share, error) {
+	ss, ok := s.st.(ShareStorage)
+	if !ok {
+		return []Share{}, errNoShares
+	}
+	if err := s.check(id, AccessRead); err != nil {
+		return []Share{}, err
+	}
+	return ss.Shares(id)
+}
+
+// SharedWith implements ShareStorage. Only shares granted
+// to s.user or groups of s.user are returned.
+func (s *userStorage) SharedWith(grantees []string) ([]Share, error) {
+	ss, ok := s.st.(ShareStorage)
+	if !ok {
+		return []Share{}, errNoShares
+	}
+	allowed := []string{}
+	for _, g := range grantees {
+		for _, mine := range s.user.grantees() {
+			if g == mine {
+				allowed = append(allowed, g)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return []Share{}, nil
+	}
+	return ss.SharedWith(allowed)
+}
+
+// Share implements ShareStorage
+func (s *userStorage) Share(sh Share) error {
+	ss, ok := s.st.(ShareStorage)
+	if !ok {
+		return errNoShares
+	}
+	if err := s.check(sh.ID, accessOwner); err != nil {
+		return err
+	}
+	return ss.Share(sh)
+}
+
+// Unshare implements ShareStorage
+func (s *userStorage) Unshare(id NoteID, grantee string) error {
+	ss, ok := s.st.(ShareStorage)
+	if !ok {
+		return errNoShares
+	}
+	if err := s.check(id, accessOwner); err != nil {
+		return err
+	}
+	return ss.Unshare(id, grantee)
+}
+
+// sees reports whether event is about note accessible to s.user
+func (s *userStorage) sees(e Event) bool {
+	shared := s.shared()
+	if e.Note != nil {
+		return s.access(*e.Note, shared) != ""
+	}
+	_, ok := s.trashed(shared)[e.ID]
+	return ok
+}
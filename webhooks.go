@@ -0,0 +1,251 @@
+package notepet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of webhook requests
+const (
+	WebhookEventHeader     = "Notepet-Event"
+	WebhookDeliveryHeader  = "Notepet-Delivery"
+	WebhookSignatureHeader = "Notepet-Signature"
+)
+
+// webhookRecent is number of deliveries kept by WebhookDispatcher
+const webhookRecent = 100
+
+// Webhook is URL receiving events of notes. If Secret is set requests
+// are signed with it. Events lists types of events sent to URL, all of
+// them are sent if it is empty.
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"-"`
+	Events []string `json:"events,omitempty"`
+}
+
+// wants reports whether events of type typ are sent to webhook
+func (h Webhook) wants(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an entry of delivery log. It records
+// single attempt to send event to webhook.
+type WebhookDelivery struct {
+	ID        string    `json:"id"` // same for all attempts to deliver the event
+	URL       string    `json:"url"`
+	Event     string    `json:"event"`
+	NoteID    NoteID    `json:"note_id"`
+	Attempt   int       `json:"attempt"`
+	Status    int       `json:"status,omitempty"` // HTTP status of response
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+	Delivered bool      `json:"delivered"`
+}
+
+// SignWebhook returns value of Notepet-Signature header of
+// webhook request with body signed with secret.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature is a valid
+// Notepet-Signature of body signed with secret.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, body)))
+}
+
+// WebhookDispatcher sends events to webhooks as JSON in POST requests.
+// Event is retried up to MaxAttempts times with delay starting at Backoff
+// and doubled after each attempt if request fails, webhook responds with
+// 5xx status or 429. All attempts are written to delivery log.
+type WebhookDispatcher struct {
+	Hooks       []Webhook
+	MaxAttempts int
+	Backoff     time.Duration
+	Client      *http.Client
+	mu          sync.Mutex
+	log         io.Writer
+	recent      []WebhookDelivery
+	wg          sync.WaitGroup
+}
+
+// NewWebhookDispatcher returns WebhookDispatcher sending events to hooks.
+// If deliverylog is not nil deliveries are written to it as JSON lines.
+func NewWebhookDispatcher(hooks []Webhook, deliverylog io.Writer) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Hooks:       hooks,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		log:         deliverylog}
+}
+
+// Run sends events to webhooks until events is closed and waits for
+// pending deliveries. Subscribe to EventBus before starting Run in
+// another goroutine so that events published meanwhile are not missed:
+//
+//	events, cancel := bus.Subscribe(256)
+//	go d.Run(events)
+func (d *WebhookDispatcher) Run(events <-chan Event) {
+	for e := range events {
+		d.Dispatch(e)
+	}
+	d.wg.Wait()
+}
+
+// Dispatch sends e to all webhooks interested in it
+// without waiting for deliveries to complete.
+func (d *WebhookDispatcher) Dispatch(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("could not encode %v event of note %v: %v\n", e.Type, e.ID, err)
+		return
+	}
+	for _, hook := range d.Hooks {
+		if !hook.wants(e.Type) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			ID:     ULIDGenerator.NewID(Note{}).String(),
+			URL:    hook.URL,
+			Event:  e.Type,
+			NoteID: e.ID}
+		d.wg.Add(1)
+		go func(hook Webhook) {
+			defer d.wg.Done()
+			d.deliver(hook, delivery, body)
+		}(hook)
+	}
+}
+
+// Deliveries returns most recent entries of delivery log
+func (d *WebhookDispatcher) Deliveries() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]WebhookDelivery{}, d.recent...)
+}
+
+// deliver sends body to hook retrying failed attempts
+func (d *WebhookDispatcher) deliver(hook Webhook, delivery WebhookDelivery, body []byte) {
+	backoff := d.Backoff
+	for delivery.Attempt = 1; ; delivery.Attempt++ {
+		retry := d.attempt(hook, &delivery, body)
+		d.record(delivery)
+		if !retry || delivery.Attempt >= d.MaxAttempts {
+			if !delivery.Delivered {
+				log.Printf("could not deliver %v event of note %v to %v: %v\n", delivery.Event, delivery.NoteID, hook.URL, delivery.Error)
+			}
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attempt makes single request to hook filling in result of
+// delivery. It reports whether request should be retried.
+func (d *WebhookDispatcher) attempt(hook Webhook, delivery *WebhookDelivery, body []byte) (retry bool) {
+	delivery.Time = time.Now()
+	delivery.Status, delivery.Error, delivery.Delivered = 0, "", false
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(hook.Secret, body))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return true
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	delivery.Status = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Delivered = true
+		return false
+	}
+	delivery.Error = resp.Status
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// record writes delivery to log and keeps it among recent ones
+func (d *WebhookDispatcher) record(delivery WebhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log != nil {
+		data, _ := json.Marshal(delivery)
+		if _, err := fmt.Fprintf(d.log, "%s\n", data); err != nil {
+			log.Printf("error writing webhook delivery log: %v\n", err)
+		}
+	}
+	d.recent = append(d.recent, delivery)
+	if len(d.recent) > webhookRecent {
+		d.recent = d.recent[len(d.recent)-webhookRecent:]
+	}
+}
+
+// ReadWebhooksFile reads webhooks from file with lines of form
+// "URL [secret [event,event...]]" where secret "-" means no secret.
+// Empty lines and lines starting with # are skipped.
+func ReadWebhooksFile(filename string) ([]Webhook, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hooks := []Webhook{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 3 || !strings.HasPrefix(fields[0], "http://") && !strings.HasPrefix(fields[0], "https://") {
+			return nil, fmt.Errorf("invalid webhook at line %v of %v", n, filename)
+		}
+		hook := Webhook{URL: fields[0]}
+		if len(fields) > 1 && fields[1] != "-" {
+			hook.Secret = fields[1]
+		}
+		if len(fields) > 2 {
+			hook.Events = strings.Split(fields[2], ",")
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, scanner.Err()
+}